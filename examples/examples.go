@@ -7,123 +7,106 @@ import (
 
 	"github.com/reche13/http-from-scratch/internal/request"
 	"github.com/reche13/http-from-scratch/internal/response"
+	"github.com/reche13/http-from-scratch/internal/router"
 )
 
-func Handler(w *response.Writer, r *request.Request) {
-	switch r.RequestLine.Path {
-	case "/":
-		home(w, r)
-	case "/bad-request":
-		badRequest(w, r)
-	case "/server-error":
-		ServerError(w, r)
-	case "/logs":
-		streamLogs(w, r)
-	case "/video":
-		streamVideo(w, r)
-	default:
-		notFound(w)
-	}
+// NewRouter returns a router serving the example pages.
+func NewRouter() *router.Router {
+	rt := router.New()
+	rt.NotFound = notFound
+	rt.Handle("GET", "/", home)
+	rt.Handle("GET", "/hello/{name}", hello)
+	rt.Handle("GET", "/bad-request", badRequest)
+	rt.Handle("GET", "/server-error", ServerError)
+	rt.Handle("GET", "/logs", streamLogs)
+	rt.Handle("GET", "/video", streamVideo)
+	return rt
 }
 
-func notFound(w *response.Writer) {
-	body := []byte(`<h1>404 Not Found</h1>`)
-	h := response.GetDefaultHeaders(len(body))
-	h.Replace("Content-Type", "text/html")
-
-	w.WriteStatusLine(response.StatusNotFound)
-	w.WriteHeaders(h)
-	w.WriteBody(body)
+func notFound(w *response.Writer, _ *request.Request) {
+	w.SetStatus(response.StatusNotFound)
+	w.Header().Replace("Content-Type", "text/html")
+	w.Write([]byte(`<h1>404 Not Found</h1>`))
 }
 
 func home(w *response.Writer, _ *request.Request) {
-	body := []byte(`<h1>Welcome to HTTP-from-scratch</h1>`)
-	h := response.GetDefaultHeaders(len(body))
-	h.Replace("Content-Type", "text/html")
+	w.Header().Replace("Content-Type", "text/html")
+	w.Write([]byte(`<h1>Welcome to HTTP-from-scratch</h1>`))
+}
 
-	w.WriteStatusLine(response.StatusOk)
-	w.WriteHeaders(h)
-	w.WriteBody(body)
+func hello(w *response.Writer, r *request.Request) {
+	w.Header().Replace("Content-Type", "text/plain")
+	w.Write([]byte("Hello, " + r.PathValue("name") + "!\n"))
 }
 
 func badRequest(w *response.Writer, _ *request.Request) {
-	body := []byte(`<h1>400 Bad Request</h1>`)
-	h := response.GetDefaultHeaders(len(body))
-	h.Replace("Content-Type", "text/html")
-
-	w.WriteStatusLine(response.StatusBadRequest)
-	w.WriteHeaders(h)
-	w.WriteBody(body)
+	w.SetStatus(response.StatusBadRequest)
+	w.Header().Replace("Content-Type", "text/html")
+	w.Write([]byte(`<h1>400 Bad Request</h1>`))
 }
 
 
 func ServerError(w *response.Writer, _ *request.Request) {
-	body := []byte(`<h1>500 Internal Server Error</h1>`)
-	h := response.GetDefaultHeaders(len(body))
-	h.Replace("Content-Type", "text/html")
-
-	w.WriteStatusLine(response.StatusInternalServerError)
-	w.WriteHeaders(h)
-	w.WriteBody(body)
+	w.SetStatus(response.StatusInternalServerError)
+	w.Header().Replace("Content-Type", "text/html")
+	w.Write([]byte(`<h1>500 Internal Server Error</h1>`))
 }
 
-func streamLogs(w *response.Writer, _ *request.Request) {
-	h := response.GetDefaultHeadersChunked()
-	h.Replace("Content-Type", "text/plain")
-
-	w.EnableChunkedEncoding(h)
-	w.WriteStatusLine(response.StatusOk)
-	w.WriteHeaders(h)
+func streamLogs(w *response.Writer, r *request.Request) {
+	w.Header().Replace("Content-Type", "text/plain")
 
 	file, err := os.Open("./sample-data/server.log")
 	if err != nil {
-		w.WriteChunk([]byte("Error opening log file\n"))
-		w.FinalizeChunkedEncoding()
+		w.Write([]byte("Error opening log file\n"))
 		return
 	}
 	defer file.Close()
 
+	ctx := r.Context()
 	buf := make([]byte, 1024)
 	for {
 		n, err := file.Read(buf)
 		if n > 0 {
-			time.Sleep(500 * time.Millisecond) // simulate delay
-			w.WriteChunk(buf[:n])
+			// simulate delay, but stop as soon as the client is gone
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(500 * time.Millisecond):
+			}
+			if _, err := w.Write(buf[:n]); err != nil {
+				return
+			}
+			if err := w.Flush(); err != nil {
+				return
+			}
 		}
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
-			w.WriteChunk([]byte("Error reading file\n"))
+			w.Write([]byte("Error reading file\n"))
 			break
 		}
 	}
-
-	w.FinalizeChunkedEncoding()
 }
 
 func streamVideo(w *response.Writer, _ *request.Request) {
 	file, err := os.Open("./sample-data/video.mp4")
 	if err != nil {
-		h := response.GetDefaultHeaders(0)
-		w.WriteStatusLine(response.StatusInternalServerError)
-		w.WriteHeaders(h)
+		w.SetStatus(response.StatusInternalServerError)
 		return
 	}
 	defer file.Close()
 
-	h := response.GetDefaultHeadersChunked()
-	h.Replace("Content-Type", "video/mp4")
-
-	w.EnableChunkedEncoding(h)
-	w.WriteStatusLine(response.StatusOk)
-	w.WriteHeaders(h)
+	w.Header().Replace("Content-Type", "video/mp4")
 
 	buf := make([]byte, 1024*64)
 	for {
 		n, err := file.Read(buf)
 		if n > 0 {
-			w.WriteChunk(buf[:n])
+			if _, err := w.Write(buf[:n]); err != nil {
+				return
+			}
 		}
 		if err == io.EOF {
 			break
@@ -132,6 +115,4 @@ func streamVideo(w *response.Writer, _ *request.Request) {
 			break
 		}
 	}
-
-	w.FinalizeChunkedEncoding()
-}
\ No newline at end of file
+}
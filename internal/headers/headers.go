@@ -6,67 +6,161 @@ import (
 	"strings"
 )
 
+// field is a single field line. The name keeps the casing it was added
+// with; lookups ignore case.
+type field struct {
+	name string
+	value string
+}
+
+// Headers is an ordered list of fields. A name may appear several times,
+// each occurrence keeping its own value, so fields such as Set-Cookie that
+// cannot be combined survive intact.
 type Headers struct {
-	headers map[string]string
+	fields []field
 }
 
 func NewHeaders() *Headers {
-	return &Headers{
-		headers: make(map[string]string),
-	}
+	return &Headers{}
 }
 
 var SEPARATOR = "\r\n"
 
 var ERROR_MALFORMED_FIELD_LINE = fmt.Errorf("malformed field-line")
 var ERROR_MALFORMED_FIELD_NAME = fmt.Errorf("malformed field-name")
+var ERROR_MALFORMED_FIELD_VALUE = fmt.Errorf("malformed field-value")
+var ERROR_NUL_IN_FIELD_VALUE = fmt.Errorf("NUL byte in field-value")
+
+// Add appends a field line, keeping any existing values for name.
+func (h *Headers) Add(name, value string) {
+	h.fields = append(h.fields, field{name: name, value: value})
+}
 
+// Set adds a value for name, like Add.
 func (h *Headers) Set(name, value string) {
-	name = strings.ToLower(name)
-	if v, ok := h.headers[name]; ok {
-		h.headers[name] = fmt.Sprintf("%s,%s", v, value)
-	} else {
-		h.headers[name] = value
-	}
+	h.Add(name, value)
 }
 
+// Replace sets name to a single value. The field keeps the position of its
+// first occurrence, or is appended if name is not present.
 func (h *Headers) Replace(name, value string) {
-	name = strings.ToLower(name)
-	h.headers[name] = value
+	replaced := false
+	fields := h.fields[:0]
+	for _, f := range h.fields {
+		if !strings.EqualFold(f.name, name) {
+			fields = append(fields, f)
+			continue
+		}
+		if !replaced {
+			fields = append(fields, field{name: name, value: value})
+			replaced = true
+		}
+	}
+	h.fields = fields
+
+	if !replaced {
+		h.Add(name, value)
+	}
 }
 
+// Get returns the values of name combined into one comma-separated value.
+// Use Values for fields that must not be combined.
 func (h *Headers) Get(name string) (string, bool) {
-	val, ok := h.headers[strings.ToLower(name)]
-	return val, ok
+	values := h.Values(name)
+	if len(values) == 0 {
+		return "", false
+	}
+	return strings.Join(values, ","), true
+}
+
+// Values returns every value of name in the order they were added.
+func (h *Headers) Values(name string) []string {
+	var values []string
+	for _, f := range h.fields {
+		if strings.EqualFold(f.name, name) {
+			values = append(values, f.value)
+		}
+	}
+	return values
 }
 
 func (h *Headers) Remove(name string) {
-	name = strings.ToLower(name)
-	delete(h.headers, name)
+	fields := h.fields[:0]
+	for _, f := range h.fields {
+		if !strings.EqualFold(f.name, name) {
+			fields = append(fields, f)
+		}
+	}
+	h.fields = fields
 }
 
+// ForEach calls cb for every field line in insertion order, with the name
+// as it was added.
 func (h *Headers) ForEach(cb func(n, v string)) {
-	for k, v := range h.headers {
-		cb(k, v)
+	for _, f := range h.fields {
+		cb(f.name, f.value)
 	}
 }
 
-func isValidToken(str []byte) bool {
+// Len returns the number of field lines.
+func (h *Headers) Len() int {
+	return len(h.fields)
+}
+
+// IsToken reports whether str consists only of tchar, the characters
+// RFC 9110 allows in a token. An empty str is not checked for.
+func IsToken(str []byte) bool {
 	for _, ch := range str {
-		if (ch >= 'A' && ch <= 'Z') ||
-           (ch >= 'a' && ch <= 'z') ||
-           (ch >= '0' && ch <= '9') {
-            continue
-        }
-        switch ch {
-        case '!', '#', '$', '%', '&', '\'', '*', '+', '-', '.', '^', '_', '`', '|', '~':
-            continue
-        }
-        return false
+		if !IsTokenChar(ch) {
+			return false
+		}
 	}
 	return true
 }
 
+func IsTokenChar(ch byte) bool {
+	if (ch >= 'A' && ch <= 'Z') ||
+		(ch >= 'a' && ch <= 'z') ||
+		(ch >= '0' && ch <= '9') {
+		return true
+	}
+	switch ch {
+	case '!', '#', '$', '%', '&', '\'', '*', '+', '-', '.', '^', '_', '`', '|', '~':
+		return true
+	}
+	return false
+}
+
+// checkFieldValue validates a field value against RFC 9110: visible ASCII,
+// obs-text, SP and HTAB. CR and LF in particular would let the value end
+// the field line early and inject fields of its own.
+func checkFieldValue(value []byte) error {
+	for _, ch := range value {
+		if ch == 0 {
+			return ERROR_NUL_IN_FIELD_VALUE
+		}
+		if ch == ' ' || ch == '\t' || (ch >= 0x21 && ch != 0x7f) {
+			continue
+		}
+		return ERROR_MALFORMED_FIELD_VALUE
+	}
+	return nil
+}
+
+// Validate checks every field name and value, so that the fields can be
+// written to the wire without altering the message framing.
+func (h *Headers) Validate() error {
+	for _, f := range h.fields {
+		if len(f.name) == 0 || !IsToken([]byte(f.name)) {
+			return fmt.Errorf("%w: %q", ERROR_MALFORMED_FIELD_NAME, f.name)
+		}
+		if err := checkFieldValue([]byte(f.value)); err != nil {
+			return fmt.Errorf("%w in field %q", err, f.name)
+		}
+	}
+	return nil
+}
+
 func parseHeader(data []byte) (string, string, error) {
 	parts := bytes.SplitN(data, []byte(":"), 2)
 	if len(parts) != 2 {
@@ -74,12 +168,18 @@ func parseHeader(data []byte) (string, string, error) {
 	}
 
 	name := parts[0]
-	value := bytes.TrimSpace(parts[1])
+	// OWS is only SP and HTAB; any other whitespace is left for
+	// checkFieldValue to judge
+	value := bytes.Trim(parts[1], " \t")
 
-	if bytes.HasSuffix(name, []byte(" ")) || !isValidToken(name) {
+	if len(name) == 0 || bytes.HasSuffix(name, []byte(" ")) || !IsToken(name) {
 		return "", "", ERROR_MALFORMED_FIELD_NAME
 	}
 
+	if err := checkFieldValue(value); err != nil {
+		return "", "", err
+	}
+
 	return string(name), string(value), nil
 }
 
@@ -107,7 +207,7 @@ func (h *Headers) Parse(data []byte) (int, bool, error) {
 		}
 
 		read += idx + len(SEPARATOR)
-		h.Set(name, value)
+		h.Add(name, value)
 	}
 
 	return read, done, nil
@@ -1,6 +1,7 @@
 package headers_test
 
 import (
+	"errors"
 	"testing"
 
 	"github.com/reche13/http-from-scratch/internal/headers"
@@ -51,6 +52,49 @@ func TestHeadersParse(t *testing.T) {
 			wantRead: 0,
 			wantErr: true,
 		},
+		{
+			name: "empty field name",
+			input: ": value\r\n\r\n",
+			wantErr: true,
+		},
+		{
+			name: "bare CR in value",
+			input: "Host: example.com\rX-Injected: yes\r\n\r\n",
+			wantErr: true,
+		},
+		{
+			name: "NUL in value",
+			input: "Host: example\x00.com\r\n\r\n",
+			wantErr: true,
+		},
+		{
+			name: "control character in value",
+			input: "Host: example\x7f.com\r\n\r\n",
+			wantErr: true,
+		},
+		{
+			name: "tab and obs-text in value",
+			input: "X-Name: caf\xe9\tbar\r\n\r\n",
+			wantRead: len("X-Name: caf\xe9\tbar\r\n\r\n"),
+			wantDone: true,
+			wantHeaders: map[string]string{
+				"x-name": "caf\xe9\tbar",
+			},
+		},
+		{
+			name: "vertical tab and form feed around value",
+			input: "X-A: \x0bfoo\x0c\r\n\r\n",
+			wantErr: true,
+		},
+		{
+			name: "only SP and HTAB trimmed",
+			input: "X-A: \t \xc2\xa0foo\xc2\x85 \t\r\n\r\n",
+			wantRead: len("X-A: \t \xc2\xa0foo\xc2\x85 \t\r\n\r\n"),
+			wantDone: true,
+			wantHeaders: map[string]string{
+				"x-a": "\xc2\xa0foo\xc2\x85",
+			},
+		},
 		{
 			name: "multiple values",
 			input: "Host: example.com\r\nHost: localhost:6969\r\n",
@@ -96,4 +140,95 @@ func TestHeadersParse(t *testing.T) {
             }
 		})
 	}
-}
\ No newline at end of file
+}
+func TestHeadersOrderAndValues(t *testing.T) {
+	h := headers.NewHeaders()
+	h.Add("Set-Cookie", "a=1; Expires=Wed, 21 Oct 2015 07:28:00 GMT")
+	h.Add("Content-Type", "text/html")
+	h.Add("set-cookie", "b=2")
+
+	values := h.Values("SET-COOKIE")
+	if len(values) != 2 || values[0] != "a=1; Expires=Wed, 21 Oct 2015 07:28:00 GMT" || values[1] != "b=2" {
+		t.Fatalf("values mismatch: got %q", values)
+	}
+
+	var got []string
+	h.ForEach(func(n, v string) {
+		got = append(got, n+": "+v)
+	})
+	want := []string{
+		"Set-Cookie: a=1; Expires=Wed, 21 Oct 2015 07:28:00 GMT",
+		"Content-Type: text/html",
+		"set-cookie: b=2",
+	}
+	if len(got) != len(want) {
+		t.Fatalf("fields mismatch: got %q want %q", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("field %d mismatch: got %q want %q", i, got[i], want[i])
+		}
+	}
+}
+
+func TestHeadersReplaceAndRemove(t *testing.T) {
+	h := headers.NewHeaders()
+	h.Add("Accept", "text/html")
+	h.Add("Host", "example.com")
+	h.Add("accept", "text/plain")
+
+	h.Replace("Accept", "*/*")
+
+	var names []string
+	h.ForEach(func(n, v string) {
+		names = append(names, n)
+	})
+	if len(names) != 2 || names[0] != "Accept" || names[1] != "Host" {
+		t.Fatalf("replace should keep the first position: got %q", names)
+	}
+	if got, _ := h.Get("accept"); got != "*/*" {
+		t.Fatalf("accept mismatch: got %q want %q", got, "*/*")
+	}
+
+	h.Remove("HOST")
+	if _, ok := h.Get("host"); ok {
+		t.Fatalf("host should have been removed")
+	}
+	if h.Len() != 1 {
+		t.Fatalf("len mismatch: got %d want %d", h.Len(), 1)
+	}
+}
+
+func TestHeadersValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		field   string
+		value   string
+		wantErr error
+	}{
+		{name: "valid", field: "X-Name", value: "some value"},
+		{name: "CRLF injection", field: "Location", value: "/\r\nSet-Cookie: evil=1", wantErr: headers.ERROR_MALFORMED_FIELD_VALUE},
+		{name: "bare LF", field: "Location", value: "/\nx", wantErr: headers.ERROR_MALFORMED_FIELD_VALUE},
+		{name: "NUL byte", field: "X-Name", value: "a\x00b", wantErr: headers.ERROR_NUL_IN_FIELD_VALUE},
+		{name: "invalid name", field: "Bad Name", value: "x", wantErr: headers.ERROR_MALFORMED_FIELD_NAME},
+		{name: "empty name", field: "", value: "x", wantErr: headers.ERROR_MALFORMED_FIELD_NAME},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := headers.NewHeaders()
+			h.Add(tt.field, tt.value)
+
+			err := h.Validate()
+			if tt.wantErr == nil {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("error: got %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,125 @@
+package request
+
+import (
+	"fmt"
+	"io"
+)
+
+var ERROR_BODY_CLOSED = fmt.Errorf("read on closed body")
+var ERROR_BODY_NOT_DISCARDED = fmt.Errorf("too much unread body to discard")
+
+// maxDiscardBytes is how much of an unread body Discard is willing to read
+// to keep a connection usable. Past that, closing the connection is cheaper.
+const maxDiscardBytes = 256 * 1024
+
+type noBody struct{}
+
+func (noBody) Read([]byte) (int, error) { return 0, io.EOF }
+func (noBody) Close() error { return nil }
+
+// NoBody is the Body of requests that carry no content.
+var NoBody io.ReadCloser = noBody{}
+
+// body streams a Content-Length or chunked request body off the connection.
+type body struct {
+	rd *Reader
+	req *Request
+	// bytes left of a Content-Length body
+	remaining int64
+	// bytes of a chunked body read so far
+	bytesRead int64
+	closed bool
+	err error
+}
+
+func (b *body) Read(p []byte) (int, error) {
+	if b.closed {
+		return 0, ERROR_BODY_CLOSED
+	}
+	return b.read(p)
+}
+
+// Close stops the handler from reading further. The unread remainder is
+// skipped by the Reader before the next request is parsed.
+func (b *body) Close() error {
+	b.closed = true
+	return nil
+}
+
+func (b *body) read(p []byte) (int, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+
+	n, err := b.readBody(p)
+	if err != nil {
+		b.err = err
+		if err == io.EOF && b.rd.OnBodyEOF != nil {
+			b.rd.OnBodyEOF()
+		}
+	}
+	return n, err
+}
+
+func (b *body) readBody(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	for {
+		switch b.req.state {
+		case StateDone:
+			return 0, io.EOF
+
+		case StateBody:
+			n, err := b.rd.readData(p[:min(int64(len(p)), b.remaining)])
+			b.remaining -= int64(n)
+			if b.remaining == 0 {
+				b.req.state = StateDone
+			}
+			return n, err
+
+		case StateChunkData:
+			if max := b.req.limits.MaxBodyBytes; max > 0 && b.bytesRead + int64(b.req.chunkRemaining) > max {
+				return 0, ERROR_BODY_TOO_LARGE
+			}
+
+			n, err := b.rd.readData(p[:min(len(p), b.req.chunkRemaining)])
+			b.req.chunkRemaining -= n
+			b.bytesRead += int64(n)
+			if b.req.chunkRemaining == 0 {
+				b.req.state = StateChunkDataEnd
+			}
+			return n, err
+
+		default:
+			if err := b.rd.advance(b.req); err != nil {
+				return 0, err
+			}
+		}
+	}
+}
+
+// discard reads the rest of the body. It gives up with
+// ERROR_BODY_NOT_DISCARDED as soon as more than max bytes are left.
+func (b *body) discard(max int64) error {
+	if b.err == nil && b.req.state == StateBody && b.remaining > max {
+		return ERROR_BODY_NOT_DISCARDED
+	}
+
+	buf := make([]byte, 4096)
+	var discarded int64
+	for {
+		n, err := b.read(buf)
+		discarded += int64(n)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if discarded > max {
+			return ERROR_BODY_NOT_DISCARDED
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package request
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+
+	"github.com/reche13/http-from-scratch/internal/headers"
+)
+
+var ERROR_MALFORMED_CHUNK_SIZE = fmt.Errorf("malformed chunk-size")
+var ERROR_MALFORMED_CHUNK_DATA = fmt.Errorf("malformed chunk-data")
+
+// maxChunkSizeLine bounds a chunk-size line, extensions included. Nothing
+// else limits it, and the line is buffered until its CRLF arrives.
+const maxChunkSizeLine = 4096
+
+// parseChunkSize parses a chunk-size line without its CRLF. Chunk
+// extensions after the size are checked but otherwise ignored.
+func parseChunkSize(line []byte) (int, error) {
+	end := 0
+	for end < len(line) && isHexDigit(line[end]) {
+		end++
+	}
+	if end == 0 || !validChunkExt(line[end:]) {
+		return 0, ERROR_MALFORMED_CHUNK_SIZE
+	}
+
+	size, err := strconv.ParseUint(string(line[:end]), 16, 31)
+	if err != nil {
+		return 0, ERROR_MALFORMED_CHUNK_SIZE
+	}
+
+	return int(size), nil
+}
+
+// validChunkExt reports whether ext is well-formed chunk-ext:
+//
+//	*( BWS ";" BWS token [ BWS "=" BWS ( token / quoted-string ) ] )
+//
+// Anything else, a bare LF in particular, could be framed differently by
+// another parser on the way, so it is refused rather than skipped.
+func validChunkExt(ext []byte) bool {
+	for {
+		ext = trimBWS(ext)
+		if len(ext) == 0 {
+			return true
+		}
+		if ext[0] != ';' {
+			return false
+		}
+
+		ext = trimBWS(ext[1:])
+		n := tokenLen(ext)
+		if n == 0 {
+			return false
+		}
+		ext = ext[n:]
+
+		if rest := trimBWS(ext); len(rest) > 0 && rest[0] == '=' {
+			ext = trimBWS(rest[1:])
+			if len(ext) > 0 && ext[0] == '"' {
+				n = quotedStringLen(ext)
+			} else {
+				n = tokenLen(ext)
+			}
+			if n == 0 {
+				return false
+			}
+			ext = ext[n:]
+		}
+	}
+}
+
+func trimBWS(b []byte) []byte {
+	return bytes.TrimLeft(b, " \t")
+}
+
+// tokenLen returns the length of the token at the start of b.
+func tokenLen(b []byte) int {
+	n := 0
+	for n < len(b) && headers.IsTokenChar(b[n]) {
+		n++
+	}
+	return n
+}
+
+// quotedStringLen returns the length of the quoted-string at the start of
+// b, or 0 if there is none.
+func quotedStringLen(b []byte) int {
+	for i := 1; i < len(b); i++ {
+		switch ch := b[i]; {
+		case ch == '"':
+			return i + 1
+		case ch == '\\':
+			i++
+			if i == len(b) || !isQuotedText(b[i]) {
+				return 0
+			}
+		case !isQuotedText(ch):
+			return 0
+		}
+	}
+	return 0
+}
+
+// isQuotedText reports whether ch may appear in a quoted-string: HTAB, SP,
+// visible ASCII and obs-text.
+func isQuotedText(ch byte) bool {
+	return ch == '\t' || ch == ' ' || (ch >= 0x21 && ch != 0x7f)
+}
+
+func isHexDigit(ch byte) bool {
+	return (ch >= '0' && ch <= '9') || (ch >= 'a' && ch <= 'f') || (ch >= 'A' && ch <= 'F')
+}
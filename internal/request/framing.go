@@ -0,0 +1,106 @@
+package request
+
+import (
+	"fmt"
+	"strings"
+)
+
+var ERROR_CONFLICTING_FRAMING = fmt.Errorf("both Transfer-Encoding and Content-Length present")
+var ERROR_INVALID_CONTENT_LENGTH = fmt.Errorf("invalid Content-Length")
+var ERROR_INVALID_TRANSFER_ENCODING = fmt.Errorf("invalid Transfer-Encoding")
+var ERROR_UNSUPPORTED_TRANSFER_CODING = fmt.Errorf("unsupported transfer-coding")
+
+// parseFraming decides how the body of the request is delimited, following
+// RFC 9112 section 6.3. Anything ambiguous is rejected rather than guessed
+// at, since a front-end proxy might have guessed differently and treated
+// part of the body as a second request.
+func (r *Request) parseFraming() error {
+	teValues := r.Headers.Values("transfer-encoding")
+	clValues := r.Headers.Values("content-length")
+
+	if len(teValues) > 0 && len(clValues) > 0 {
+		return ERROR_CONFLICTING_FRAMING
+	}
+
+	if len(teValues) > 0 {
+		// Transfer-Encoding did not exist in HTTP/1.0, so a 1.0 message
+		// carrying it may have passed through something that ignored it
+		if r.RequestLine.ProtoMinor == 0 {
+			return ERROR_INVALID_TRANSFER_ENCODING
+		}
+
+		codings := splitList(teValues)
+		if len(codings) == 0 {
+			return ERROR_INVALID_TRANSFER_ENCODING
+		}
+
+		// chunked must be applied exactly once, as the final coding
+		for i, coding := range codings {
+			isChunked := strings.EqualFold(coding, "chunked")
+			last := i == len(codings)-1
+			if isChunked != last {
+				return ERROR_INVALID_TRANSFER_ENCODING
+			}
+		}
+		if len(codings) > 1 {
+			// no other codings can be decoded
+			return ERROR_UNSUPPORTED_TRANSFER_CODING
+		}
+
+		r.chunked = true
+		return nil
+	}
+
+	if len(clValues) > 0 {
+		// a list of identical values is allowed, differing ones are not
+		lengths := splitList(clValues)
+		if len(lengths) == 0 {
+			return ERROR_INVALID_CONTENT_LENGTH
+		}
+		for _, l := range lengths {
+			if l != lengths[0] {
+				return ERROR_INVALID_CONTENT_LENGTH
+			}
+		}
+
+		n, ok := parseContentLength(lengths[0])
+		if !ok {
+			return ERROR_INVALID_CONTENT_LENGTH
+		}
+		r.contentLength = n
+	}
+
+	return nil
+}
+
+// parseContentLength accepts only 1*DIGIT, without the signs, spaces or
+// prefixes strconv would let through.
+func parseContentLength(s string) (int64, bool) {
+	if len(s) == 0 || len(s) > 18 {
+		return 0, false
+	}
+
+	var n int64
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return 0, false
+		}
+		n = n*10 + int64(s[i]-'0')
+	}
+	return n, true
+}
+
+// splitList splits comma-separated field values into their elements,
+// dropping empty ones.
+func splitList(values []string) []string {
+	var elements []string
+	for _, v := range values {
+		for _, e := range strings.Split(v, ",") {
+			e = strings.TrimSpace(e)
+			if e != "" {
+				elements = append(elements, e)
+			}
+		}
+	}
+	return elements
+}
@@ -0,0 +1,88 @@
+package request
+
+import (
+	"strings"
+)
+
+// PathPolicy decides what happens to a request whose decoded path is not
+// in canonical form, see CleanPath.
+type PathPolicy int
+
+const (
+	// PathRedirect answers with a redirect to the canonical path.
+	PathRedirect PathPolicy = iota
+	// PathReject answers with 400 Bad Request.
+	PathReject
+	// PathPassThrough hands the path to the handler untouched.
+	PathPassThrough
+)
+
+// CleanPath returns the canonical form of a decoded origin-form path:
+// "." and ".." segments are resolved without ever climbing above the root,
+// repeated slashes are collapsed and trailing dots are stripped from
+// segments, since some filesystems ignore them ("secret.txt." opens
+// "secret.txt"). A trailing slash is kept.
+func CleanPath(p string) string {
+	if p == "" || p[0] != '/' {
+		return p
+	}
+
+	segments := strings.Split(p[1:], "/")
+	out := make([]string, 0, len(segments))
+	trailingSlash := false
+
+	for i, seg := range segments {
+		last := i == len(segments)-1
+
+		switch seg {
+		case "", ".":
+			trailingSlash = last
+		case "..":
+			if len(out) > 0 {
+				out = out[:len(out)-1]
+			}
+			trailingSlash = last
+		default:
+			seg = strings.TrimRight(seg, ".")
+			if seg == "" {
+				// "..." and longer name nothing but the segment itself
+				trailingSlash = last
+				continue
+			}
+			out = append(out, seg)
+			trailingSlash = false
+		}
+	}
+
+	cleaned := "/" + strings.Join(out, "/")
+	if trailingSlash && len(out) > 0 {
+		cleaned += "/"
+	}
+	return cleaned
+}
+
+// EscapePath percent-encodes a decoded path so that it can be sent back to
+// the client, for example in a Location header.
+func EscapePath(p string) string {
+	var b strings.Builder
+	for i := 0; i < len(p); i++ {
+		ch := p[i]
+		if isPathChar(ch) {
+			b.WriteByte(ch)
+			continue
+		}
+		b.WriteByte('%')
+		b.WriteByte("0123456789ABCDEF"[ch>>4])
+		b.WriteByte("0123456789ABCDEF"[ch&0x0f])
+	}
+	return b.String()
+}
+
+// isPathChar reports whether ch may appear unescaped in a path: unreserved,
+// sub-delims, ":", "@" and "/".
+func isPathChar(ch byte) bool {
+	if (ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z') || (ch >= '0' && ch <= '9') {
+		return true
+	}
+	return strings.IndexByte("-._~!$&'()*+,;=:@/", ch) != -1
+}
@@ -0,0 +1,104 @@
+package request
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCleanPath(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/", "/"},
+		{"/a/b", "/a/b"},
+		{"/a/b/", "/a/b/"},
+		{"/a/./b", "/a/b"},
+		{"/a/../b", "/b"},
+		{"/a/b/..", "/a/"},
+		{"/a/b/.", "/a/b/"},
+		{"//x", "/x"},
+		{"/a//b///c", "/a/b/c"},
+		{"/..", "/"},
+		{"/../../etc/passwd", "/etc/passwd"},
+		{"/a/../../b", "/b"},
+		{"/secret.txt.", "/secret.txt"},
+		{"/a../b", "/a/b"},
+		{"/a/.../b", "/a/b"},
+		{"/.hidden", "/.hidden"},
+		{"/v1.2/x", "/v1.2/x"},
+	}
+
+	for _, tt := range tests {
+		if got := CleanPath(tt.path); got != tt.want {
+			t.Errorf("CleanPath(%q): got %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestTraversalPayloads(t *testing.T) {
+	tests := []struct {
+		name string
+		target string
+		clean string
+		err error
+	}{
+		{"dot-dot", "/static/../../etc/passwd", "/etc/passwd", nil},
+		{"encoded dot-dot", "/static/%2e%2e/%2e%2e/etc/passwd", "/etc/passwd", nil},
+		{"upper-case encoding", "/static/%2E%2E/secret", "/secret", nil},
+		{"half-encoded dot-dot", "/static/.%2e/secret", "/secret", nil},
+		{"double slash", "//etc/passwd", "/etc/passwd", nil},
+		{"trailing dot", "/static/secret.txt.", "/static/secret.txt", nil},
+		{"encoded slash", "/static/..%2f..%2fetc/passwd", "", ERROR_ENCODED_SLASH},
+		{"encoded slash upper-case", "/static/..%2F..%2Fetc/passwd", "", ERROR_ENCODED_SLASH},
+		{"encoded nul", "/static/secret.txt%00.png", "", ERROR_MALFORMED_TARGET},
+		{"double encoding", "/static/%252e%252e/secret", "/static/%2e%2e/secret", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := ReadRequest(strings.NewReader("GET " + tt.target + " HTTP/1.1\r\nHost: x\r\n\r\n"))
+			if err != tt.err {
+				t.Fatalf("error: got %v, want %v", err, tt.err)
+			}
+			if err != nil {
+				return
+			}
+			if got := CleanPath(r.Target.Path); got != tt.clean {
+				t.Fatalf("clean path: got %q, want %q", got, tt.clean)
+			}
+		})
+	}
+}
+
+func TestAllowEncodedSlash(t *testing.T) {
+	rd := NewReader(strings.NewReader("GET /a%2Fb HTTP/1.1\r\nHost: x\r\n\r\n"))
+	rd.AllowEncodedSlash = true
+
+	r, err := rd.ReadRequest()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if r.Target.Path != "/a/b" || r.Target.RawPath != "/a%2Fb" {
+		t.Fatalf("target: got path %q raw %q", r.Target.Path, r.Target.RawPath)
+	}
+}
+
+func TestEscapePath(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/a/b", "/a/b"},
+		{"/a b", "/a%20b"},
+		{"/café", "/caf%C3%A9"},
+		{"/a?b#c", "/a%3Fb%23c"},
+		{"/%2e", "/%252e"},
+	}
+
+	for _, tt := range tests {
+		if got := EscapePath(tt.path); got != tt.want {
+			t.Errorf("EscapePath(%q): got %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
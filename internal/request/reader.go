@@ -0,0 +1,221 @@
+package request
+
+import (
+	"io"
+	"time"
+)
+
+// Reader reads successive requests from a single connection. Bytes that
+// arrive after the end of one request, such as a pipelined request sent in
+// the same write, are kept for the next call to ReadRequest.
+type Reader struct {
+	// AllowEncodedSlash lets %2F through in request paths. They are
+	// refused by default, see Target.
+	AllowEncodedSlash bool
+	// OnBodyEOF, if set, is called once a request body has been read to its
+	// end, from the goroutine reading it. From then on the Reader is free
+	// to ReadAhead.
+	OnBodyEOF func()
+	src io.Reader
+	limits Limits
+	buf []byte
+	start int
+	end int
+	// body of the last request returned, which may not be fully read yet
+	body *body
+	// consumed counts the bytes consumed from the buffer so far, and
+	// arrivals records when the reads that filled the unconsumed part of
+	// the buffer returned, in the same count
+	consumed int64
+	arrivals []arrival
+}
+
+// arrival is a read into the buffer that ended at byte end and returned at
+// the given time.
+type arrival struct {
+	end int64
+	at time.Time
+}
+
+func NewReader(src io.Reader) *Reader {
+	return NewReaderWithLimits(src, DefaultLimits)
+}
+
+func NewReaderWithLimits(src io.Reader, limits Limits) *Reader {
+	return &Reader{
+		src: src,
+		limits: limits,
+		buf: make([]byte, 1024),
+	}
+}
+
+// ReadRequest reads the next request line and header section. It returns
+// as soon as the headers are parsed; the body is read lazily through
+// Request.Body. Any part of the previous request's body that was not read
+// is discarded first.
+func (rd *Reader) ReadRequest() (*Request, error) {
+	if err := rd.Discard(); err != nil {
+		return nil, err
+	}
+
+	request := newRequest(rd.limits)
+	request.allowEncodedSlash = rd.AllowEncodedSlash
+
+	for {
+		// leftovers from the previous request may already hold a full one
+		if rd.end > rd.start {
+			if request.Received.IsZero() {
+				request.Received = rd.arrivals[0].at
+			}
+			readN, err := request.parse(rd.buffered())
+			if err != nil {
+				return nil, err
+			}
+			rd.consume(readN)
+		}
+
+		if request.headersDone() {
+			break
+		}
+
+		if err := rd.fill(); err != nil {
+			return nil, err
+		}
+	}
+
+	if !request.Done() {
+		rd.body = &body{
+			rd: rd,
+			req: request,
+			remaining: request.contentLength,
+		}
+		request.Body = rd.body
+	}
+
+	return request, nil
+}
+
+// Ready blocks until the first byte of the next request is available,
+// which lets callers tell an idle connection apart from one that is in the
+// middle of sending a request.
+func (rd *Reader) Ready() error {
+	if rd.end > rd.start {
+		return nil
+	}
+	return rd.fill()
+}
+
+// ReadAhead reads whatever the client sends after the current request into
+// the buffer, where the next ReadRequest finds it. A server can run it in
+// the background while a handler runs, to notice the client closing the
+// connection. It must not run while the current request's body may still
+// be read.
+func (rd *Reader) ReadAhead() error {
+	return rd.fill()
+}
+
+// Discard skips whatever is left of the last request's body so that the
+// next request can be read. It fails if the body is malformed, if the
+// connection ends before the body does, or with ERROR_BODY_NOT_DISCARDED if
+// more than 256 KiB are left, in which case the connection should be closed
+// rather than read any further.
+func (rd *Reader) Discard() error {
+	if rd.body == nil {
+		return nil
+	}
+
+	b := rd.body
+	rd.body = nil
+	return b.discard(maxDiscardBytes)
+}
+
+func (rd *Reader) buffered() []byte {
+	return rd.buf[rd.start:rd.end]
+}
+
+func (rd *Reader) consume(n int) {
+	rd.consumed += int64(n)
+	for len(rd.arrivals) > 0 && rd.arrivals[0].end <= rd.consumed {
+		rd.arrivals = rd.arrivals[1:]
+	}
+
+	rd.start += n
+	if rd.start == rd.end {
+		rd.start = 0
+		rd.end = 0
+	}
+}
+
+// fill reads more data from the source into the free end of the buffer,
+// growing the buffer when it is full. The parser bounds every line it waits
+// for: the request line and field lines by Limits, chunk-size lines by
+// maxChunkSizeLine. So the buffer never grows much past those bounds.
+func (rd *Reader) fill() error {
+	if rd.start > 0 {
+		copy(rd.buf, rd.buf[rd.start:rd.end])
+		rd.end -= rd.start
+		rd.start = 0
+	}
+
+	if rd.end == len(rd.buf) {
+		buf := make([]byte, 2*len(rd.buf))
+		copy(buf, rd.buf[:rd.end])
+		rd.buf = buf
+	}
+
+	n, err := rd.src.Read(rd.buf[rd.end:])
+	rd.end += n
+	if n > 0 {
+		rd.arrivals = append(rd.arrivals, arrival{
+			end: rd.consumed + int64(rd.end - rd.start),
+			at: time.Now(),
+		})
+		return nil
+	}
+	return err
+}
+
+// readData reads body bytes into p, serving buffered bytes first and going
+// to the source directly once the buffer is empty.
+func (rd *Reader) readData(p []byte) (int, error) {
+	if rd.end > rd.start {
+		n := copy(p, rd.buffered())
+		rd.consume(n)
+		return n, nil
+	}
+
+	n, err := rd.src.Read(p)
+	if err == io.EOF {
+		if n > 0 {
+			return n, nil
+		}
+		return 0, io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// advance runs the parser over buffered body framing (chunk-size lines,
+// chunk delimiters and trailers), reading more data if nothing could be
+// parsed.
+func (rd *Reader) advance(r *Request) error {
+	state := r.state
+	readN, err := r.parse(rd.buffered())
+	if err != nil {
+		return err
+	}
+	rd.consume(readN)
+
+	if readN == 0 && r.state == state {
+		err := rd.fill()
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	return nil
+}
+
+// ReadRequest reads a single request from reader using DefaultLimits.
+func ReadRequest(reader io.Reader) (*Request, error) {
+	return NewReader(reader).ReadRequest()
+}
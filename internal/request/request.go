@@ -2,9 +2,13 @@ package request
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"io"
-	"strconv"
+	"strings"
+	"time"
 
 	"github.com/reche13/http-from-scratch/internal/headers"
 )
@@ -15,60 +19,176 @@ const (
 	StateInit ParserState = "init"
 	StateHeaders ParserState = "headers"
 	StateBody ParserState = "body"
+	StateChunkSize ParserState = "chunk-size"
+	StateChunkData ParserState = "chunk-data"
+	StateChunkDataEnd ParserState = "chunk-data-end"
+	StateTrailers ParserState = "trailers"
 	StateDone ParserState = "done"
 	StateError ParserState = "error"
 )
 
 type Request struct {
 	RequestLine RequestLine
+	// Target is the parsed form of RequestLine.Path.
+	Target Target
 	Headers *headers.Headers
-	Body string
+	// Body streams the request body from the connection as the handler
+	// reads it. It is never nil; requests without a body get NoBody.
+	Body io.ReadCloser
+	// Trailers holds the trailer fields sent after a chunked body. It is
+	// only populated once Body has been read to the end.
+	Trailers *headers.Headers
+	// RemoteAddr and LocalAddr are the addresses of the client and server
+	// ends of the connection the request arrived on, set by the server.
+	RemoteAddr string
+	LocalAddr string
+	// ConnID identifies the connection among those accepted by the server.
+	ConnID uint64
+	// Seq is the request's position on its connection, starting at 1.
+	Seq int
+	// Received is when the read that delivered the first byte of the
+	// request returned.
+	Received time.Time
+	// TLS describes the TLS connection the request arrived on, or is nil
+	// for a plain connection.
+	TLS *tls.ConnectionState
+	// pathValues holds the path parameters captured by a router
+	pathValues map[string]string
+	ctx context.Context
 	state ParserState
+	chunkRemaining int
+	chunked bool
+	contentLength int64
+	limits Limits
+	allowEncodedSlash bool
+	headerBytes int
+	headerCount int
 }
 
 type RequestLine struct {
 	Method string
 	Path string
 	HttpVersion string
+	ProtoMajor int
+	ProtoMinor int
 }
 
-var ERROR_INCOMPLETE_START_LINE = fmt.Errorf("incomplete start-line")
 var ERROR_MALFORMED_REQUEST_LINE = fmt.Errorf("malformed request-line")
+var ERROR_UNSUPPORTED_VERSION = fmt.Errorf("unsupported HTTP version")
 var ERROR_REQUEST_IN_ERROR_STATE = fmt.Errorf("request in error state")
+var ERROR_REQUEST_LINE_TOO_LONG = fmt.Errorf("request-line too long")
+var ERROR_HEADERS_TOO_LARGE = fmt.Errorf("header section too large")
+var ERROR_BODY_TOO_LARGE = fmt.Errorf("body too large")
+
+// Limits bounds how much a client may send in a single request. A zero
+// field means no limit.
+type Limits struct {
+	MaxRequestLineBytes int
+	// MaxHeaderBytes bounds the header section, and separately the trailer
+	// section of a chunked body.
+	MaxHeaderBytes int
+	MaxHeaderCount int
+	MaxBodyBytes int64
+}
+
+var DefaultLimits = Limits{
+	MaxRequestLineBytes: 8 * 1024,
+	MaxHeaderBytes: 64 * 1024,
+	MaxHeaderCount: 100,
+}
 
 var SEPARATOR = []byte("\r\n")
 
-func newRequest() *Request {
+func newRequest(limits Limits) *Request {
 	return &Request{
 		state: StateInit,
+		limits: limits,
 		Headers: headers.NewHeaders(),
-		Body: "",
+		Body: NoBody,
+		Trailers: headers.NewHeaders(),
 	}
 }
 
-func getIntHeader(h *headers.Headers, name string, defaultvalue int) int {
-	valStr, ok := h.Get(name)
-	if !ok {
-		return defaultvalue
+// KeepAlive reports whether the client is willing to send further requests
+// on the same connection once this one has been answered.
+// HTTP/1.0 clients must opt in with Connection: keep-alive.
+func (r *Request) KeepAlive() bool {
+	conn, _ := r.Headers.Get("connection")
+	if r.RequestLine.ProtoMinor == 0 {
+		return hasToken(conn, "keep-alive")
 	}
+	return !hasToken(conn, "close")
+}
 
-	val, err := strconv.Atoi(valStr)
-	if err != nil {
-		return defaultvalue
+// Context returns the request's context. A server cancels it when the
+// client goes away, the server is closed without waiting for requests to
+// finish, or the request runs out of time.
+// It is never nil.
+func (r *Request) Context() context.Context {
+	if r.ctx == nil {
+		return context.Background()
+	}
+	return r.ctx
+}
+
+// SetContext replaces the request's context.
+func (r *Request) SetContext(ctx context.Context) {
+	r.ctx = ctx
+}
+
+// PeerChain returns the client's certificate chain, from its own
+// certificate up to a trusted root, if the server verified it. Otherwise it
+// returns nil, even when the client sent a certificate.
+func (r *Request) PeerChain() []*x509.Certificate {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return nil
+	}
+	return r.TLS.VerifiedChains[0]
+}
+
+// PeerSubject returns the subject of the client's verified certificate,
+// such as "CN=alice,O=Example", or "" if there is none.
+func (r *Request) PeerSubject() string {
+	chain := r.PeerChain()
+	if len(chain) == 0 {
+		return ""
 	}
+	return chain[0].Subject.String()
+}
 
-	return val
+// PathValue returns the value of the named path parameter captured when the
+// request was routed, or "" if there is none.
+func (r *Request) PathValue(name string) string {
+	return r.pathValues[name]
 }
 
-func (r *Request) hasBody() bool {
-	contentLength := getIntHeader(r.Headers, "content-length", 0)
-	return contentLength > 0
+// SetPathValue records the value of a path parameter, see PathValue.
+func (r *Request) SetPathValue(name, value string) {
+	if r.pathValues == nil {
+		r.pathValues = make(map[string]string)
+	}
+	r.pathValues[name] = value
+}
+
+func hasToken(value, token string) bool {
+	for _, t := range strings.Split(value, ",") {
+		if strings.EqualFold(strings.TrimSpace(t), token) {
+			return true
+		}
+	}
+	return false
 }
 
 func (r *Request) Done() bool {
 	return r.state == StateDone || r.state == StateError
 }
 
+// headersDone reports whether the request line and header section have been
+// parsed, which is all a handler needs to start running.
+func (r *Request) headersDone() bool {
+	return r.state != StateInit && r.state != StateHeaders
+}
+
 func (r *Request) parse(data []byte) (int, error) {
 	read := 0
 
@@ -80,6 +200,16 @@ func (r *Request) parse(data []byte) (int, error) {
 			return 0, ERROR_REQUEST_IN_ERROR_STATE
 
 		case StateInit:
+			// a line without its CRLF yet can already be too long
+			lineLen := bytes.Index(currentData, SEPARATOR)
+			if lineLen == -1 {
+				lineLen = len(currentData)
+			}
+			if max := r.limits.MaxRequestLineBytes; max > 0 && lineLen > max {
+				r.state = StateError
+				return 0, ERROR_REQUEST_LINE_TOO_LONG
+			}
+
 			rl, n, err := parseRequestLine(currentData)
 			if err != nil {
 				r.state = StateError
@@ -88,6 +218,13 @@ func (r *Request) parse(data []byte) (int, error) {
 			if n == 0 {
 				break outer
 			}
+
+			target, err := parseTarget(rl.Method, rl.Path, r.allowEncodedSlash)
+			if err != nil {
+				r.state = StateError
+				return 0, err
+			}
+			r.Target = target
 			r.RequestLine = *rl
 			read += n
 			r.state = StateHeaders
@@ -98,34 +235,98 @@ func (r *Request) parse(data []byte) (int, error) {
 				r.state = StateError
 				return 0, err
 			}
+			if err := r.checkHeaderLimits(currentData, n, done); err != nil {
+				r.state = StateError
+				return 0, err
+			}
 			if n == 0 {
 				break outer
 			}
 			read += n
 
 			if done {
-				if r.hasBody() {
+				// the trailer section gets a budget of its own
+				r.headerBytes = 0
+				r.headerCount = 0
+
+				if err := r.parseFraming(); err != nil {
+					r.state = StateError
+					return 0, err
+				}
+
+				if r.chunked {
+					r.state = StateChunkSize
+				} else if r.contentLength > 0 {
+					if max := r.limits.MaxBodyBytes; max > 0 && r.contentLength > max {
+						r.state = StateError
+						return 0, ERROR_BODY_TOO_LARGE
+					}
 					r.state = StateBody
 				} else {
 					r.state = StateDone
 				}
+				// the body is left to Request.Body
+				break outer
 			}
 		
-		case StateBody:
-			contentLength := getIntHeader(r.Headers, "content-length", 0)
-			if contentLength == 0 {
-				r.state = StateDone
-				break
+		case StateBody, StateChunkData:
+			// body bytes are handed to the handler by the body reader
+			break outer
+
+		case StateChunkSize:
+			idx := bytes.Index(currentData, SEPARATOR)
+			if idx > maxChunkSizeLine || (idx == -1 && len(currentData) > maxChunkSizeLine) {
+				r.state = StateError
+				return 0, ERROR_MALFORMED_CHUNK_SIZE
+			}
+			if idx == -1 {
+				break outer
+			}
+
+			size, err := parseChunkSize(currentData[:idx])
+			if err != nil {
+				r.state = StateError
+				return 0, err
+			}
+			read += idx + len(SEPARATOR)
+
+			if size == 0 {
+				r.state = StateTrailers
+			} else {
+				r.chunkRemaining = size
+				r.state = StateChunkData
+			}
+
+		case StateChunkDataEnd:
+			if len(currentData) < len(SEPARATOR) {
+				break outer
+			}
+			if !bytes.HasPrefix(currentData, SEPARATOR) {
+				r.state = StateError
+				return 0, ERROR_MALFORMED_CHUNK_DATA
 			}
+			read += len(SEPARATOR)
+			r.state = StateChunkSize
 
-			remaining := min(contentLength - len(r.Body), len(currentData))
-			r.Body += string(currentData[:remaining])
-			read += remaining
+		case StateTrailers:
+			n, done, err := r.Trailers.Parse(currentData)
+			if err != nil {
+				r.state = StateError
+				return 0, err
+			}
+			if err := r.checkHeaderLimits(currentData, n, done); err != nil {
+				r.state = StateError
+				return 0, err
+			}
+			if n == 0 {
+				break outer
+			}
+			read += n
 
-			if len(r.Body) == contentLength {
+			if done {
 				r.state = StateDone
 			}
-			// body
+
 		case StateDone:
 			break outer 
 
@@ -137,11 +338,38 @@ func (r *Request) parse(data []byte) (int, error) {
 	return read, nil
 }
 
+// checkHeaderLimits accounts for n bytes of field lines consumed from data
+// and fails once the section grows past the configured limits, including
+// when a single field line that has not fully arrived is already too big.
+func (r *Request) checkHeaderLimits(data []byte, n int, done bool) error {
+	r.headerBytes += n
+	r.headerCount += bytes.Count(data[:n], SEPARATOR)
+	if done {
+		// the empty line ending the section is not a field
+		r.headerCount--
+	}
+
+	pending := 0
+	if !done {
+		pending = len(data) - n
+	}
+
+	if max := r.limits.MaxHeaderBytes; max > 0 && r.headerBytes + pending > max {
+		return ERROR_HEADERS_TOO_LARGE
+	}
+	if max := r.limits.MaxHeaderCount; max > 0 && r.headerCount > max {
+		return ERROR_HEADERS_TOO_LARGE
+	}
+	return nil
+}
+
+// parseRequestLine parses the request-line at the start of b. It returns
+// 0 bytes read and no error when the line has not fully arrived yet.
 func parseRequestLine(b []byte) (*RequestLine, int, error) {
 	idx := bytes.Index(b, SEPARATOR)
 
 	if idx == -1 {
-		return nil, 0, ERROR_INCOMPLETE_START_LINE
+		return nil, 0, nil
 	}
 
 	startLine := b[:idx]
@@ -154,42 +382,44 @@ func parseRequestLine(b []byte) (*RequestLine, int, error) {
 		return nil, 0, ERROR_MALFORMED_REQUEST_LINE
 	}
 
-	httpVersionParts := bytes.Split(parts[2], []byte("/"))
-	if len(httpVersionParts) != 2 || string(httpVersionParts[0]) != "HTTP" || string(httpVersionParts[1]) != "1.1" {
+	// a bare CR or LF in the method would end the line early for a parser
+	// that accepts them as line endings
+	if len(parts[0]) == 0 || !headers.IsToken(parts[0]) {
 		return nil, 0, ERROR_MALFORMED_REQUEST_LINE
 	}
 
+	major, minor, err := parseHttpVersion(parts[2])
+	if err != nil {
+		return nil, 0, err
+	}
+
 
 	rl := &RequestLine{
 		Method: string(parts[0]),
 		Path: string(parts[1]),
 		HttpVersion: string(parts[2]),
+		ProtoMajor: major,
+		ProtoMinor: minor,
 	}
 
 	return rl, read, nil
 }
 
-func ReadRequest(reader io.Reader) (*Request, error) {
-	request := newRequest()
-
-	buf := make([]byte, 1024)
-	bufLen := 0
-
-	for !request.Done() {
-		n, err := reader.Read(buf[bufLen:])
-		if err != nil {
-			return nil, err
-		}
-
-		bufLen += n
-		readN, err := request.parse(buf[:bufLen])
-		if err != nil {
-			return nil, err
-		}
+// parseHttpVersion parses an HTTP-version of the form HTTP/DIGIT.DIGIT.
+// Only major version 1 is supported; any 1.x newer than 1.1 is served as
+// HTTP/1.1.
+func parseHttpVersion(v []byte) (int, int, error) {
+	if len(v) != len("HTTP/1.1") || !bytes.HasPrefix(v, []byte("HTTP/")) || v[6] != '.' {
+		return 0, 0, ERROR_MALFORMED_REQUEST_LINE
+	}
 
-		copy(buf, buf[readN:bufLen])
-		bufLen -= readN
+	major, minor := v[5], v[7]
+	if major < '0' || major > '9' || minor < '0' || minor > '9' {
+		return 0, 0, ERROR_MALFORMED_REQUEST_LINE
+	}
+	if major != '1' {
+		return 0, 0, ERROR_UNSUPPORTED_VERSION
 	}
 
-	return request, nil
-}
\ No newline at end of file
+	return 1, int(minor - '0'), nil
+}
@@ -1,8 +1,13 @@
 package request
 
 import (
+	"fmt"
+	"io"
+	"reflect"
 	"strings"
 	"testing"
+	"testing/iotest"
+	"time"
 )
 
 func TestReadRequest(t *testing.T) {
@@ -91,6 +96,15 @@ func TestReadRequest(t *testing.T) {
 
 
 
+func readBody(t *testing.T, r *Request) string {
+	t.Helper()
+	b, err := io.ReadAll(r.Body)
+	if err != nil {
+		t.Fatalf("reading body: %v", err)
+	}
+	return string(b)
+}
+
 func TestBody(t *testing.T) {
 	raw := "" +
 		"POST /submit HTTP/1.1\r\n" +
@@ -104,12 +118,722 @@ func TestBody(t *testing.T) {
 		t.Fatalf("unexpected error: %v", err)
 	}
 
+	if r.state != StateBody {
+		t.Fatalf("body should be left for the handler, state = %v", r.state)
+	}
+
 	expectedBody := "Hello World"
-	if r.Body != expectedBody {
-		t.Fatalf("expected body %s, got %s", expectedBody, r.Body)
+	if body := readBody(t, r); body != expectedBody {
+		t.Fatalf("expected body %s, got %s", expectedBody, body)
 	}
 
 	if r.state != StateDone {
 		t.Fatalf("request should be done, state = %v", r.state)
 	}
-}
\ No newline at end of file
+}
+
+func TestReaderPipelined(t *testing.T) {
+	raw := "" +
+		"POST /first HTTP/1.1\r\n" +
+		"Host: example.com\r\n" +
+		"Content-Length: 5\r\n" +
+		"\r\n" +
+		"Hello" +
+		"GET /second HTTP/1.1\r\n" +
+		"Host: example.com\r\n" +
+		"\r\n"
+
+	rd := NewReader(strings.NewReader(raw))
+
+	first, err := rd.ReadRequest()
+	if err != nil {
+		t.Fatalf("first request: unexpected error: %v", err)
+	}
+	if first.RequestLine.Path != "/first" {
+		t.Fatalf("first request: got path %q", first.RequestLine.Path)
+	}
+	// the unread body must be skipped before the next request is parsed
+
+	second, err := rd.ReadRequest()
+	if err != nil {
+		t.Fatalf("second request: unexpected error: %v", err)
+	}
+	if second.RequestLine.Path != "/second" {
+		t.Fatalf("second request: got path %q", second.RequestLine.Path)
+	}
+
+	if _, err := rd.ReadRequest(); err != io.EOF {
+		t.Fatalf("expected io.EOF after last request, got %v", err)
+	}
+}
+
+func TestChunkedBody(t *testing.T) {
+	head := "" +
+		"POST /upload HTTP/1.1\r\n" +
+		"Host: example.com\r\n" +
+		"Transfer-Encoding: chunked\r\n" +
+		"\r\n"
+
+	tests := []struct {
+		name         string
+		body         string
+		wantErr      bool
+		wantBody     string
+		wantTrailers map[string]string
+	}{
+		{
+			name:     "simple chunks",
+			body:     "5\r\nHello\r\n6\r\n World\r\n0\r\n\r\n",
+			wantBody: "Hello World",
+		},
+		{
+			name:     "uppercase hex and extensions",
+			body:     "A;name=value\r\n0123456789\r\n1 ; ext\r\n!\r\n0;last\r\n\r\n",
+			wantBody: "0123456789!",
+		},
+		{
+			name:     "quoted extension values",
+			body:     "5;a=\"x;\\\"y\" ;b = c\r\nHello\r\n0\r\n\r\n",
+			wantBody: "Hello",
+		},
+		{
+			name:     "trailers",
+			body:     "5\r\nHello\r\n0\r\nChecksum: abc\r\nExpires: never\r\n\r\n",
+			wantBody: "Hello",
+			wantTrailers: map[string]string{
+				"checksum": "abc",
+				"expires":  "never",
+			},
+		},
+		{
+			name:    "invalid chunk size",
+			body:    "zz\r\nHello\r\n0\r\n\r\n",
+			wantErr: true,
+		},
+		{
+			name:    "missing chunk size",
+			body:    ";ext\r\nHello\r\n0\r\n\r\n",
+			wantErr: true,
+		},
+		{
+			name:    "chunk longer than its size",
+			body:    "3\r\nHello\r\n0\r\n\r\n",
+			wantErr: true,
+		},
+		{
+			name:    "malformed trailer",
+			body:    "0\r\nbad trailer\r\n\r\n",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := ReadRequest(strings.NewReader(head + tt.body))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			body, err := io.ReadAll(r.Body)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected error but got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if string(body) != tt.wantBody {
+				t.Fatalf("body: got %q, want %q", body, tt.wantBody)
+			}
+
+			for k, v := range tt.wantTrailers {
+				got, _ := r.Trailers.Get(k)
+				if got != v {
+					t.Fatalf("trailer %s mismatch: got %q want %q", k, got, v)
+				}
+				if _, ok := r.Headers.Get(k); ok {
+					t.Fatalf("trailer %s should not be merged into headers", k)
+				}
+			}
+		})
+	}
+}
+
+func TestBodyIsStreamed(t *testing.T) {
+	pr, pw := io.Pipe()
+	defer pr.Close()
+
+	go func() {
+		io.WriteString(pw, "POST /upload HTTP/1.1\r\nContent-Length: 10\r\n\r\n")
+		// the rest of the body only arrives once the handler reads it
+		io.WriteString(pw, "01234")
+		io.WriteString(pw, "56789")
+		pw.Close()
+	}()
+
+	r, err := ReadRequest(pr)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if body := readBody(t, r); body != "0123456789" {
+		t.Fatalf("body: got %q, want %q", body, "0123456789")
+	}
+	if !r.Done() {
+		t.Fatalf("request should be done once the body is read, state = %v", r.state)
+	}
+}
+
+func TestBodyTruncated(t *testing.T) {
+	raw := "" +
+		"POST /upload HTTP/1.1\r\n" +
+		"Content-Length: 10\r\n" +
+		"\r\n" +
+		"short"
+
+	r, err := ReadRequest(strings.NewReader(raw))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, err := io.ReadAll(r.Body); err != io.ErrUnexpectedEOF {
+		t.Fatalf("expected io.ErrUnexpectedEOF, got %v", err)
+	}
+}
+
+func TestBodyClosed(t *testing.T) {
+	raw := "" +
+		"POST /upload HTTP/1.1\r\n" +
+		"Content-Length: 5\r\n" +
+		"\r\n" +
+		"Hello"
+
+	r, err := ReadRequest(strings.NewReader(raw))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	r.Body.Close()
+	if _, err := r.Body.Read(make([]byte, 5)); err != ERROR_BODY_CLOSED {
+		t.Fatalf("expected ERROR_BODY_CLOSED, got %v", err)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	limits := Limits{
+		MaxRequestLineBytes: 2048,
+		MaxHeaderBytes:      4096,
+		MaxHeaderCount:      3,
+		MaxBodyBytes:        10,
+	}
+
+	manyHeaders := "A: 1\r\nB: 2\r\nC: 3\r\nD: 4\r\n"
+	bigHeader := "X-Big: " + strings.Repeat("x", 5000) + "\r\n"
+
+	tests := []struct {
+		name        string
+		input       string
+		wantErr     error
+		wantBodyErr error
+	}{
+		{
+			name:  "request-line longer than the initial buffer",
+			input: "GET /" + strings.Repeat("a", 1500) + " HTTP/1.1\r\n\r\n",
+		},
+		{
+			name:    "request-line too long",
+			input:   "GET /" + strings.Repeat("a", 3000) + " HTTP/1.1\r\n\r\n",
+			wantErr: ERROR_REQUEST_LINE_TOO_LONG,
+		},
+		{
+			name:    "unterminated request-line too long",
+			input:   "GET /" + strings.Repeat("a", 3000),
+			wantErr: ERROR_REQUEST_LINE_TOO_LONG,
+		},
+		{
+			name:    "header section too large",
+			input:   "GET / HTTP/1.1\r\n" + bigHeader + "\r\n",
+			wantErr: ERROR_HEADERS_TOO_LARGE,
+		},
+		{
+			name:    "unterminated header too large",
+			input:   "GET / HTTP/1.1\r\n" + bigHeader[:4500],
+			wantErr: ERROR_HEADERS_TOO_LARGE,
+		},
+		{
+			name:    "too many headers",
+			input:   "GET / HTTP/1.1\r\n" + manyHeaders + "\r\n",
+			wantErr: ERROR_HEADERS_TOO_LARGE,
+		},
+		{
+			name:    "content-length too large",
+			input:   "POST / HTTP/1.1\r\nContent-Length: 11\r\n\r\nHello World",
+			wantErr: ERROR_BODY_TOO_LARGE,
+		},
+		{
+			name:        "chunked body too large",
+			input:       "POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nHello\r\n6\r\n World\r\n0\r\n\r\n",
+			wantBodyErr: ERROR_BODY_TOO_LARGE,
+		},
+		{
+			name:        "too many trailers",
+			input:       "POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n" + manyHeaders + "\r\n",
+			wantBodyErr: ERROR_HEADERS_TOO_LARGE,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rd := NewReaderWithLimits(strings.NewReader(tt.input), limits)
+
+			r, err := rd.ReadRequest()
+			if err != tt.wantErr {
+				t.Fatalf("error: got %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			if _, err := io.ReadAll(r.Body); err != tt.wantBodyErr {
+				t.Fatalf("body error: got %v, want %v", err, tt.wantBodyErr)
+			}
+		})
+	}
+}
+
+func TestFragmentedInput(t *testing.T) {
+	tests := []struct {
+		name         string
+		input        string
+		wantPath     string
+		wantHdrs     map[string]string
+		wantBody     string
+		wantTrailers map[string]string
+	}{
+		{
+			name:     "no body",
+			input:    "GET /hello HTTP/1.1\r\nHost: example.com\r\nUser-Agent: curl\r\n\r\n",
+			wantPath: "/hello",
+			wantHdrs: map[string]string{"host": "example.com", "user-agent": "curl"},
+		},
+		{
+			name:     "content-length body",
+			input:    "POST /submit HTTP/1.1\r\nHost: example.com\r\nContent-Length: 11\r\n\r\nHello World",
+			wantPath: "/submit",
+			wantHdrs: map[string]string{"host": "example.com"},
+			wantBody: "Hello World",
+		},
+		{
+			name: "chunked body with trailers",
+			input: "POST /upload HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n" +
+				"5;ext=1\r\nHello\r\n6\r\n World\r\n0\r\nChecksum: abc\r\n\r\n",
+			wantPath:     "/upload",
+			wantBody:     "Hello World",
+			wantTrailers: map[string]string{"checksum": "abc"},
+		},
+	}
+
+	// the same request followed by a pipelined one, to check that no
+	// bytes of the next request are lost at any split point
+	next := "GET /next HTTP/1.1\r\n\r\n"
+
+	check := func(t *testing.T, src io.Reader, i int) {
+		t.Helper()
+		tt := tests[i]
+
+		rd := NewReader(src)
+		r, err := rd.ReadRequest()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if r.RequestLine.Path != tt.wantPath {
+			t.Fatalf("path: got %q, want %q", r.RequestLine.Path, tt.wantPath)
+		}
+		for k, v := range tt.wantHdrs {
+			if got, _ := r.Headers.Get(k); got != v {
+				t.Fatalf("header %s mismatch: got %q want %q", k, got, v)
+			}
+		}
+		if body := readBody(t, r); body != tt.wantBody {
+			t.Fatalf("body: got %q, want %q", body, tt.wantBody)
+		}
+		for k, v := range tt.wantTrailers {
+			if got, _ := r.Trailers.Get(k); got != v {
+				t.Fatalf("trailer %s mismatch: got %q want %q", k, got, v)
+			}
+		}
+
+		second, err := rd.ReadRequest()
+		if err != nil {
+			t.Fatalf("next request: unexpected error: %v", err)
+		}
+		if second.RequestLine.Path != "/next" {
+			t.Fatalf("next request: got path %q", second.RequestLine.Path)
+		}
+	}
+
+	for i, tt := range tests {
+		raw := tt.input + next
+
+		t.Run(tt.name+"/one byte at a time", func(t *testing.T) {
+			check(t, iotest.OneByteReader(strings.NewReader(raw)), i)
+		})
+
+		t.Run(tt.name+"/every split point", func(t *testing.T) {
+			for split := 1; split < len(raw); split++ {
+				src := io.MultiReader(strings.NewReader(raw[:split]), strings.NewReader(raw[split:]))
+				check(t, src, i)
+			}
+		})
+	}
+}
+
+func TestHttpVersion(t *testing.T) {
+	tests := []struct {
+		version   string
+		wantErr   error
+		wantMinor int
+	}{
+		{version: "HTTP/1.0", wantMinor: 0},
+		{version: "HTTP/1.1", wantMinor: 1},
+		{version: "HTTP/1.2", wantMinor: 2},
+		{version: "HTTP/2.0", wantErr: ERROR_UNSUPPORTED_VERSION},
+		{version: "HTTP/0.9", wantErr: ERROR_UNSUPPORTED_VERSION},
+		{version: "HTTP/1", wantErr: ERROR_MALFORMED_REQUEST_LINE},
+		{version: "HTTP/1.10", wantErr: ERROR_MALFORMED_REQUEST_LINE},
+		{version: "http/1.1", wantErr: ERROR_MALFORMED_REQUEST_LINE},
+		{version: "HTTP/a.b", wantErr: ERROR_MALFORMED_REQUEST_LINE},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.version, func(t *testing.T) {
+			r, err := ReadRequest(strings.NewReader("GET / " + tt.version + "\r\n\r\n"))
+			if err != tt.wantErr {
+				t.Fatalf("error: got %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			if r.RequestLine.ProtoMajor != 1 || r.RequestLine.ProtoMinor != tt.wantMinor {
+				t.Fatalf("version: got %d.%d, want 1.%d",
+					r.RequestLine.ProtoMajor, r.RequestLine.ProtoMinor, tt.wantMinor)
+			}
+		})
+	}
+}
+
+func TestKeepAlive(t *testing.T) {
+	tests := []struct {
+		name       string
+		version    string
+		connection string
+		want       bool
+	}{
+		{name: "HTTP/1.1 default", version: "HTTP/1.1", want: true},
+		{name: "HTTP/1.1 close", version: "HTTP/1.1", connection: "close", want: false},
+		{name: "HTTP/1.1 close among tokens", version: "HTTP/1.1", connection: "Upgrade, Close", want: false},
+		{name: "HTTP/1.0 default", version: "HTTP/1.0", want: false},
+		{name: "HTTP/1.0 keep-alive", version: "HTTP/1.0", connection: "Keep-Alive", want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw := "GET / " + tt.version + "\r\n"
+			if tt.connection != "" {
+				raw += "Connection: " + tt.connection + "\r\n"
+			}
+			raw += "\r\n"
+
+			r, err := ReadRequest(strings.NewReader(raw))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if r.KeepAlive() != tt.want {
+				t.Fatalf("keep-alive: got %v, want %v", r.KeepAlive(), tt.want)
+			}
+		})
+	}
+}
+
+func TestParseTarget(t *testing.T) {
+	tests := []struct {
+		name    string
+		method  string
+		target  string
+		wantErr bool
+		want    Target
+	}{
+		{
+			name:   "origin-form",
+			method: "GET",
+			target: "/hello",
+			want:   Target{Form: OriginForm, Path: "/hello", RawPath: "/hello", Query: Query{}},
+		},
+		{
+			name:   "query string",
+			method: "GET",
+			target: "/search?q=go+lang&tag=a&tag=b&empty",
+			want: Target{
+				Form:     OriginForm,
+				Path:     "/search",
+				RawPath:  "/search",
+				RawQuery: "q=go+lang&tag=a&tag=b&empty",
+				Query:    Query{"q": {"go lang"}, "tag": {"a", "b"}, "empty": {""}},
+			},
+		},
+		{
+			name:   "percent-encoded path and query",
+			method: "GET",
+			target: "/caf%C3%A9/a%20b?name=J%C3%BCrgen%26co",
+			want: Target{
+				Form:     OriginForm,
+				Path:     "/café/a b",
+				RawPath:  "/caf%C3%A9/a%20b",
+				RawQuery: "name=J%C3%BCrgen%26co",
+				Query:    Query{"name": {"Jürgen&co"}},
+			},
+		},
+		{
+			name:   "fragment",
+			method: "GET",
+			target: "/docs?page=2#intro",
+			want: Target{
+				Form:     OriginForm,
+				Path:     "/docs",
+				RawPath:  "/docs",
+				RawQuery: "page=2",
+				Query:    Query{"page": {"2"}},
+				Fragment: "intro",
+			},
+		},
+		{
+			name:   "absolute-form",
+			method: "GET",
+			target: "HTTP://example.com:8080/a/b?x=1",
+			want: Target{
+				Form:     AbsoluteForm,
+				Scheme:   "http",
+				Host:     "example.com:8080",
+				Path:     "/a/b",
+				RawPath:  "/a/b",
+				RawQuery: "x=1",
+				Query:    Query{"x": {"1"}},
+			},
+		},
+		{
+			name:   "absolute-form without path",
+			method: "GET",
+			target: "http://example.com?x=1",
+			want: Target{
+				Form:     AbsoluteForm,
+				Scheme:   "http",
+				Host:     "example.com",
+				Path:     "/",
+				RawPath:  "/",
+				RawQuery: "x=1",
+				Query:    Query{"x": {"1"}},
+			},
+		},
+		{
+			name:   "authority-form",
+			method: "CONNECT",
+			target: "example.com:443",
+			want:   Target{Form: AuthorityForm, Host: "example.com:443", Query: Query{}},
+		},
+		{
+			name:   "asterisk-form",
+			method: "OPTIONS",
+			target: "*",
+			want:   Target{Form: AsteriskForm, Path: "*", RawPath: "*", Query: Query{}},
+		},
+		{name: "asterisk-form for GET", method: "GET", target: "*", wantErr: true},
+		{name: "authority-form without port", method: "CONNECT", target: "example.com", wantErr: true},
+		{name: "authority-form with path", method: "CONNECT", target: "example.com:443/x", wantErr: true},
+		{name: "relative path", method: "GET", target: "hello", wantErr: true},
+		{name: "absolute-form without host", method: "GET", target: "http:///path", wantErr: true},
+		{name: "invalid scheme", method: "GET", target: "1http://example.com/", wantErr: true},
+		{name: "truncated escape", method: "GET", target: "/a%2", wantErr: true},
+		{name: "invalid escape", method: "GET", target: "/a%zz", wantErr: true},
+		{name: "invalid escape in query", method: "GET", target: "/a?x=%g1", wantErr: true},
+		{name: "control character", method: "GET", target: "/a\x7fb", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseTarget(tt.method, tt.target, false)
+
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected error but got %+v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("target mismatch:\n got %+v\nwant %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRequestTarget(t *testing.T) {
+	r, err := ReadRequest(strings.NewReader("GET /users?id=42 HTTP/1.1\r\nHost: x\r\n\r\n"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if r.RequestLine.Path != "/users?id=42" {
+		t.Fatalf("raw target: got %q, want %q", r.RequestLine.Path, "/users?id=42")
+	}
+	if r.Target.Path != "/users" || r.Target.Query.Get("id") != "42" {
+		t.Fatalf("target: got path %q id %q", r.Target.Path, r.Target.Query.Get("id"))
+	}
+
+	if _, err := ReadRequest(strings.NewReader("GET /a%zz HTTP/1.1\r\n\r\n")); err != ERROR_MALFORMED_TARGET {
+		t.Fatalf("error: got %v, want %v", err, ERROR_MALFORMED_TARGET)
+	}
+}
+
+// repeatReader produces the same byte forever.
+type repeatReader byte
+
+func (r repeatReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = byte(r)
+	}
+	return len(p), nil
+}
+
+func TestChunkSizeLineLimit(t *testing.T) {
+	tests := []struct {
+		name string
+		prefix string
+		repeat byte
+	}{
+		{name: "endless extension", prefix: "1;", repeat: 'a'},
+		{name: "endless size", prefix: "", repeat: '0'},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := io.MultiReader(
+				strings.NewReader("POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n" + tt.prefix),
+				repeatReader(tt.repeat),
+			)
+
+			rd := NewReader(src)
+			r, err := rd.ReadRequest()
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if _, err := io.ReadAll(r.Body); err != ERROR_MALFORMED_CHUNK_SIZE {
+				t.Fatalf("error: got %v, want %v", err, ERROR_MALFORMED_CHUNK_SIZE)
+			}
+			if len(rd.buf) > 4 * maxChunkSizeLine {
+				t.Fatalf("buffer grew to %d bytes", len(rd.buf))
+			}
+		})
+	}
+
+	// a long line within the limit is fine
+	ext := strings.Repeat("a", maxChunkSizeLine - 10)
+	raw := "POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n5;" + ext + "\r\nHello\r\n0\r\n\r\n"
+	r, err := ReadRequest(strings.NewReader(raw))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if body, err := io.ReadAll(r.Body); err != nil || string(body) != "Hello" {
+		t.Fatalf("body: got %q, %v", body, err)
+	}
+}
+
+func TestDiscardLimit(t *testing.T) {
+	body := strings.Repeat("x", maxDiscardBytes + 1)
+	raw := fmt.Sprintf("POST / HTTP/1.1\r\nContent-Length: %d\r\n\r\n%sGET / HTTP/1.1\r\n\r\n", len(body), body)
+
+	rd := NewReader(strings.NewReader(raw))
+	if _, err := rd.ReadRequest(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := rd.Discard(); err != ERROR_BODY_NOT_DISCARDED {
+		t.Fatalf("error: got %v, want %v", err, ERROR_BODY_NOT_DISCARDED)
+	}
+
+	chunked := "POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n" +
+		strings.Repeat("400\r\n" + strings.Repeat("x", 0x400) + "\r\n", 300) + "0\r\n\r\n"
+	rd = NewReader(strings.NewReader(chunked))
+	if _, err := rd.ReadRequest(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := rd.Discard(); err != ERROR_BODY_NOT_DISCARDED {
+		t.Fatalf("chunked error: got %v, want %v", err, ERROR_BODY_NOT_DISCARDED)
+	}
+}
+
+// slowReader returns each of its chunks from a separate read, waiting
+// before every read but the first.
+type slowReader struct {
+	chunks []string
+	delay time.Duration
+	reads int
+}
+
+func (s *slowReader) Read(p []byte) (int, error) {
+	if len(s.chunks) == 0 {
+		return 0, io.EOF
+	}
+	if s.reads > 0 {
+		time.Sleep(s.delay)
+	}
+	s.reads++
+	n := copy(p, s.chunks[0])
+	s.chunks[0] = s.chunks[0][n:]
+	if s.chunks[0] == "" {
+		s.chunks = s.chunks[1:]
+	}
+	return n, nil
+}
+
+func TestReceived(t *testing.T) {
+	src := &slowReader{
+		chunks: []string{
+			"GET /a HTTP/1.1\r\n\r\nGET /b HTTP/1.1\r\n\r\nGET /c",
+			" HTTP/1.1\r\n\r\n",
+			"GET /d HTTP/1.1\r\n\r\n",
+		},
+		delay: 20 * time.Millisecond,
+	}
+	rd := NewReader(src)
+
+	before := time.Now()
+	received := map[string]time.Time{}
+	for _, path := range []string{"/a", "/b", "/c", "/d"} {
+		r, err := rd.ReadRequest()
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", path, err)
+		}
+		received[path] = r.Received
+		// a slow handler must not make pipelined requests look later
+		time.Sleep(30 * time.Millisecond)
+	}
+
+	if received["/a"].Before(before) {
+		t.Fatalf("/a received before reading started")
+	}
+	// /b and the start of /c arrived in the same read as /a
+	if !received["/b"].Equal(received["/a"]) || !received["/c"].Equal(received["/a"]) {
+		t.Fatalf("pipelined requests: got %v and %v, want %v", received["/b"], received["/c"], received["/a"])
+	}
+	if !received["/d"].After(received["/c"]) {
+		t.Fatalf("/d: got %v, want after %v", received["/d"], received["/c"])
+	}
+}
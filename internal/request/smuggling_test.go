@@ -0,0 +1,291 @@
+package request
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/reche13/http-from-scratch/internal/headers"
+)
+
+// Payloads from the usual request smuggling playbooks (CL.TE, TE.CL,
+// TE.TE and friends). Each one is ambiguous about where the body ends, so
+// the parser must refuse it instead of picking an interpretation.
+func TestSmugglingPayloads(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		wantErr error
+	}{
+		{
+			name: "CL.TE",
+			input: "POST / HTTP/1.1\r\n" +
+				"Host: example.com\r\n" +
+				"Content-Length: 13\r\n" +
+				"Transfer-Encoding: chunked\r\n" +
+				"\r\n" +
+				"0\r\n\r\nSMUGGLED",
+			wantErr: ERROR_CONFLICTING_FRAMING,
+		},
+		{
+			name: "TE.CL",
+			input: "POST / HTTP/1.1\r\n" +
+				"Host: example.com\r\n" +
+				"Transfer-Encoding: chunked\r\n" +
+				"Content-Length: 3\r\n" +
+				"\r\n" +
+				"8\r\nSMUGGLED\r\n0\r\n\r\n",
+			wantErr: ERROR_CONFLICTING_FRAMING,
+		},
+		{
+			name: "TE.TE with unknown coding",
+			input: "POST / HTTP/1.1\r\n" +
+				"Transfer-Encoding: chunked\r\n" +
+				"Transfer-Encoding: x\r\n" +
+				"\r\n",
+			wantErr: ERROR_INVALID_TRANSFER_ENCODING,
+		},
+		{
+			name: "TE.TE with chunked not last",
+			input: "POST / HTTP/1.1\r\n" +
+				"Transfer-Encoding: chunked, identity\r\n" +
+				"\r\n",
+			wantErr: ERROR_INVALID_TRANSFER_ENCODING,
+		},
+		{
+			name: "chunked applied twice",
+			input: "POST / HTTP/1.1\r\n" +
+				"Transfer-Encoding: chunked\r\n" +
+				"Transfer-Encoding: chunked\r\n" +
+				"\r\n",
+			wantErr: ERROR_INVALID_TRANSFER_ENCODING,
+		},
+		{
+			name: "obfuscated chunked",
+			input: "POST / HTTP/1.1\r\n" +
+				"Transfer-Encoding: xchunked\r\n" +
+				"\r\n",
+			wantErr: ERROR_INVALID_TRANSFER_ENCODING,
+		},
+		{
+			name: "empty transfer-encoding",
+			input: "POST / HTTP/1.1\r\n" +
+				"Transfer-Encoding: \r\n" +
+				"\r\n",
+			wantErr: ERROR_INVALID_TRANSFER_ENCODING,
+		},
+		{
+			name: "space before colon",
+			input: "POST / HTTP/1.1\r\n" +
+				"Transfer-Encoding : chunked\r\n" +
+				"\r\n",
+			wantErr: headers.ERROR_MALFORMED_FIELD_NAME,
+		},
+		{
+			name: "folded transfer-encoding",
+			input: "POST / HTTP/1.1\r\n" +
+				"Transfer-Encoding:\r\n" +
+				" chunked\r\n" +
+				"\r\n",
+			wantErr: headers.ERROR_MALFORMED_FIELD_LINE,
+		},
+		{
+			name: "unsupported coding before chunked",
+			input: "POST / HTTP/1.1\r\n" +
+				"Transfer-Encoding: gzip, chunked\r\n" +
+				"\r\n",
+			wantErr: ERROR_UNSUPPORTED_TRANSFER_CODING,
+		},
+		{
+			name: "transfer-encoding in HTTP/1.0",
+			input: "POST / HTTP/1.0\r\n" +
+				"Transfer-Encoding: chunked\r\n" +
+				"\r\n" +
+				"0\r\n\r\n",
+			wantErr: ERROR_INVALID_TRANSFER_ENCODING,
+		},
+		{
+			name: "bare LF in method",
+			input: "G\nET / HTTP/1.1\r\n" +
+				"Host: example.com\r\n" +
+				"\r\n",
+			wantErr: ERROR_MALFORMED_REQUEST_LINE,
+		},
+		{
+			name: "bare CR in method",
+			input: "G\rET / HTTP/1.1\r\n" +
+				"Host: example.com\r\n" +
+				"\r\n",
+			wantErr: ERROR_MALFORMED_REQUEST_LINE,
+		},
+		{
+			name: "bare LF in target",
+			input: "GET /a\nb HTTP/1.1\r\n" +
+				"Host: example.com\r\n" +
+				"\r\n",
+			wantErr: ERROR_MALFORMED_TARGET,
+		},
+		{
+			name: "bare CR in version",
+			input: "GET / HTTP/1.1\r\r\n" +
+				"Host: example.com\r\n" +
+				"\r\n",
+			wantErr: ERROR_MALFORMED_REQUEST_LINE,
+		},
+		{
+			name: "duplicate differing content-length",
+			input: "POST / HTTP/1.1\r\n" +
+				"Content-Length: 5\r\n" +
+				"Content-Length: 13\r\n" +
+				"\r\n",
+			wantErr: ERROR_INVALID_CONTENT_LENGTH,
+		},
+		{
+			name: "differing content-length list",
+			input: "POST / HTTP/1.1\r\n" +
+				"Content-Length: 5, 13\r\n" +
+				"\r\n",
+			wantErr: ERROR_INVALID_CONTENT_LENGTH,
+		},
+		{
+			name: "negative content-length",
+			input: "POST / HTTP/1.1\r\n" +
+				"Content-Length: -1\r\n" +
+				"\r\n",
+			wantErr: ERROR_INVALID_CONTENT_LENGTH,
+		},
+		{
+			name: "signed content-length",
+			input: "POST / HTTP/1.1\r\n" +
+				"Content-Length: +5\r\n" +
+				"\r\n",
+			wantErr: ERROR_INVALID_CONTENT_LENGTH,
+		},
+		{
+			name: "hex content-length",
+			input: "POST / HTTP/1.1\r\n" +
+				"Content-Length: 0x5\r\n" +
+				"\r\n",
+			wantErr: ERROR_INVALID_CONTENT_LENGTH,
+		},
+		{
+			name: "garbage content-length",
+			input: "POST / HTTP/1.1\r\n" +
+				"Content-Length: five\r\n" +
+				"\r\n",
+			wantErr: ERROR_INVALID_CONTENT_LENGTH,
+		},
+		{
+			name: "empty content-length",
+			input: "POST / HTTP/1.1\r\n" +
+				"Content-Length: \r\n" +
+				"\r\n",
+			wantErr: ERROR_INVALID_CONTENT_LENGTH,
+		},
+		{
+			name: "overflowing content-length",
+			input: "POST / HTTP/1.1\r\n" +
+				"Content-Length: 99999999999999999999\r\n" +
+				"\r\n",
+			wantErr: ERROR_INVALID_CONTENT_LENGTH,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ReadRequest(strings.NewReader(tt.input))
+			if err == nil {
+				t.Fatalf("expected %v, request was accepted", tt.wantErr)
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("error: got %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// Malformed chunk framing must fail the body rather than be resynchronised,
+// otherwise the leftover bytes would be parsed as the next request.
+func TestSmugglingChunkFraming(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+	}{
+		{name: "hex prefix", body: "0x5\r\nHello\r\n0\r\n\r\n"},
+		{name: "signed size", body: "+5\r\nHello\r\n0\r\n\r\n"},
+		{name: "negative size", body: "-1\r\nHello\r\n0\r\n\r\n"},
+		{name: "overflowing size", body: "ffffffffffffffffffff\r\nHello\r\n0\r\n\r\n"},
+		{name: "data longer than size", body: "1\r\nHello\r\n0\r\n\r\n"},
+		{name: "leading space", body: " 5\r\nHello\r\n0\r\n\r\n"},
+		{name: "bare LF in extension", body: "2;x\nyy\r\nab\r\n0\r\n\r\n"},
+		{name: "bare CR in extension", body: "2;x\ryy\r\nab\r\n0\r\n\r\n"},
+		{name: "extension without name", body: "2;\r\nab\r\n0\r\n\r\n"},
+		{name: "extension without value", body: "2;x=\r\nab\r\n0\r\n\r\n"},
+		{name: "unterminated quoted extension", body: "2;x=\"yy\r\nab\r\n0\r\n\r\n"},
+		{name: "garbage after size", body: "2 x\r\nab\r\n0\r\n\r\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw := "POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n" + tt.body +
+				"GET /smuggled HTTP/1.1\r\n\r\n"
+
+			rd := NewReader(strings.NewReader(raw))
+			r, err := rd.ReadRequest()
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if _, err := io.ReadAll(r.Body); err == nil {
+				t.Fatalf("expected malformed chunked body to fail")
+			}
+		})
+	}
+}
+
+func TestAllowedFraming(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		wantBody string
+	}{
+		{
+			name: "identical content-length list",
+			input: "POST / HTTP/1.1\r\n" +
+				"Content-Length: 5, 5\r\n" +
+				"\r\n" +
+				"Hello",
+			wantBody: "Hello",
+		},
+		{
+			name: "identical repeated content-length",
+			input: "POST / HTTP/1.1\r\n" +
+				"Content-Length: 5\r\n" +
+				"Content-Length: 5\r\n" +
+				"\r\n" +
+				"Hello",
+			wantBody: "Hello",
+		},
+		{
+			name: "case-insensitive chunked",
+			input: "POST / HTTP/1.1\r\n" +
+				"Transfer-Encoding: Chunked\r\n" +
+				"\r\n" +
+				"5\r\nHello\r\n0\r\n\r\n",
+			wantBody: "Hello",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := ReadRequest(strings.NewReader(tt.input))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if body := readBody(t, r); body != tt.wantBody {
+				t.Fatalf("body: got %q, want %q", body, tt.wantBody)
+			}
+		})
+	}
+}
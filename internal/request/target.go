@@ -0,0 +1,247 @@
+package request
+
+import (
+	"fmt"
+	"strings"
+)
+
+var ERROR_MALFORMED_TARGET = fmt.Errorf("malformed request-target")
+var ERROR_ENCODED_SLASH = fmt.Errorf("encoded slash in path")
+
+// TargetForm is one of the four request-target forms of RFC 9112 section
+// 3.2.
+type TargetForm int
+
+const (
+	// /path?query, used by almost every request
+	OriginForm TargetForm = iota
+	// http://host/path?query, used when talking to a proxy
+	AbsoluteForm
+	// host:port, only used by CONNECT
+	AuthorityForm
+	// *, only used by a server-wide OPTIONS
+	AsteriskForm
+)
+
+// Query maps each query parameter to its values, in the order they
+// appeared.
+type Query map[string][]string
+
+// Get returns the first value of key, or an empty string.
+func (q Query) Get(key string) string {
+	if values := q[key]; len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// Target is the parsed request-target of a request.
+type Target struct {
+	Form TargetForm
+	// Scheme is only set for the absolute-form.
+	Scheme string
+	// Host is set for the absolute-form and the authority-form.
+	Host string
+	// Path is the percent-decoded path. It is "*" for the asterisk-form
+	// and empty for the authority-form.
+	Path string
+	// RawPath is the path as the client sent it.
+	RawPath string
+	RawQuery string
+	Query Query
+	Fragment string
+}
+
+// parseTarget parses the request-target of a request made with method.
+// An encoded slash (%2F) in the path is refused unless allowEncodedSlash is
+// set: once decoded it cannot be told apart from a real path separator.
+func parseTarget(method, raw string, allowEncodedSlash bool) (Target, error) {
+	t := Target{Query: Query{}}
+
+	for i := 0; i < len(raw); i++ {
+		if raw[i] <= ' ' || raw[i] == 0x7f {
+			return t, ERROR_MALFORMED_TARGET
+		}
+	}
+
+	switch {
+	case raw == "":
+		return t, ERROR_MALFORMED_TARGET
+
+	case raw == "*":
+		if method != "OPTIONS" {
+			return t, ERROR_MALFORMED_TARGET
+		}
+		t.Form = AsteriskForm
+		t.Path = "*"
+		t.RawPath = "*"
+		return t, nil
+
+	case method == "CONNECT":
+		if !validAuthority(raw) {
+			return t, ERROR_MALFORMED_TARGET
+		}
+		t.Form = AuthorityForm
+		t.Host = raw
+		return t, nil
+
+	case raw[0] == '/':
+		t.Form = OriginForm
+
+	default:
+		scheme, rest, ok := strings.Cut(raw, "://")
+		if !ok || !validScheme(scheme) {
+			return t, ERROR_MALFORMED_TARGET
+		}
+
+		host := rest
+		if idx := strings.IndexAny(rest, "/?#"); idx != -1 {
+			host = rest[:idx]
+		}
+		if host == "" {
+			return t, ERROR_MALFORMED_TARGET
+		}
+
+		t.Form = AbsoluteForm
+		t.Scheme = strings.ToLower(scheme)
+		t.Host = host
+		raw = rest[len(host):]
+	}
+
+	raw, t.Fragment, _ = strings.Cut(raw, "#")
+	raw, t.RawQuery, _ = strings.Cut(raw, "?")
+
+	if raw == "" {
+		// an absolute-form target may leave the path out
+		raw = "/"
+	}
+	t.RawPath = raw
+
+	if !allowEncodedSlash && strings.Contains(strings.ToLower(raw), "%2f") {
+		return t, ERROR_ENCODED_SLASH
+	}
+
+	path, err := unescape(raw, false)
+	if err != nil {
+		return t, err
+	}
+	if strings.IndexByte(path, 0) != -1 {
+		return t, ERROR_MALFORMED_TARGET
+	}
+	t.Path = path
+
+	query, err := parseQuery(t.RawQuery)
+	if err != nil {
+		return t, err
+	}
+	t.Query = query
+
+	return t, nil
+}
+
+// parseQuery parses an application/x-www-form-urlencoded query string.
+func parseQuery(raw string) (Query, error) {
+	q := Query{}
+
+	for _, pair := range strings.Split(raw, "&") {
+		if pair == "" {
+			continue
+		}
+
+		rawKey, rawValue, _ := strings.Cut(pair, "=")
+		key, err := unescape(rawKey, true)
+		if err != nil {
+			return q, err
+		}
+		value, err := unescape(rawValue, true)
+		if err != nil {
+			return q, err
+		}
+
+		q[key] = append(q[key], value)
+	}
+
+	return q, nil
+}
+
+// unescape decodes %XX escapes, and '+' as a space when plusIsSpace is set.
+func unescape(s string, plusIsSpace bool) (string, error) {
+	if !strings.ContainsAny(s, "%+") {
+		return s, nil
+	}
+
+	var b strings.Builder
+	b.Grow(len(s))
+
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '%':
+			if i+2 >= len(s) || !isHex(s[i+1]) || !isHex(s[i+2]) {
+				return "", ERROR_MALFORMED_TARGET
+			}
+			b.WriteByte(unhex(s[i+1])<<4 | unhex(s[i+2]))
+			i += 2
+		case s[i] == '+' && plusIsSpace:
+			b.WriteByte(' ')
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+
+	return b.String(), nil
+}
+
+func isHex(ch byte) bool {
+	return (ch >= '0' && ch <= '9') || (ch >= 'a' && ch <= 'f') || (ch >= 'A' && ch <= 'F')
+}
+
+func unhex(ch byte) byte {
+	switch {
+	case ch >= 'a':
+		return ch - 'a' + 10
+	case ch >= 'A':
+		return ch - 'A' + 10
+	default:
+		return ch - '0'
+	}
+}
+
+// validScheme checks scheme = ALPHA *( ALPHA / DIGIT / "+" / "-" / "." ).
+func validScheme(scheme string) bool {
+	if scheme == "" {
+		return false
+	}
+
+	for i := 0; i < len(scheme); i++ {
+		ch := scheme[i]
+		isAlpha := (ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z')
+		if isAlpha {
+			continue
+		}
+		if i > 0 && ((ch >= '0' && ch <= '9') || ch == '+' || ch == '-' || ch == '.') {
+			continue
+		}
+		return false
+	}
+	return true
+}
+
+// validAuthority checks the host:port of an authority-form target. The
+// port is required.
+func validAuthority(authority string) bool {
+	idx := strings.LastIndexByte(authority, ':')
+	if idx <= 0 || idx == len(authority)-1 {
+		return false
+	}
+
+	host, port := authority[:idx], authority[idx+1:]
+	if strings.ContainsAny(host, "/?#@") {
+		return false
+	}
+	for i := 0; i < len(port); i++ {
+		if port[i] < '0' || port[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
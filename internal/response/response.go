@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"io"
 	"strconv"
+	"strings"
 
 	"github.com/reche13/http-from-scratch/internal/headers"
 )
@@ -13,89 +14,293 @@ type Response struct {
 }
 
 type StatusCode int
+
+var ERROR_INVALID_STATUS_CODE = fmt.Errorf("invalid status code")
+var ERROR_INVALID_REASON_PHRASE = fmt.Errorf("invalid reason-phrase")
+var ERROR_STATUS_ALREADY_WRITTEN = fmt.Errorf("status line already written")
+var ERROR_HEADERS_ALREADY_WRITTEN = fmt.Errorf("headers already written")
+var ERROR_CHUNKED_NOT_ENABLED = fmt.Errorf("chunked encoding not enabled")
+var ERROR_RESPONSE_FINISHED = fmt.Errorf("response already finished")
+var ERROR_BODY_NOT_ALLOWED = fmt.Errorf("response status does not allow a body")
+
+// writerState tracks how far a response has been written. A response moves
+// strictly forward through the states.
+type writerState int
+
 const (
-	StatusOk StatusCode = 200
-	StatusBadRequest StatusCode = 400
-	StatusNotFound StatusCode = 404
-	StatusInternalServerError StatusCode = 500
+	stateStatusLine writerState = iota
+	stateHeaders
+	stateBody
+	stateFinished
 )
 
+// DefaultBufferSize is how much of a body written with Write is held back
+// before the response switches to chunked encoding.
+const DefaultBufferSize = 4096
+
 type Writer struct {
 	writer io.Writer
+	state writerState
 	chunked bool
+	keepAlive bool
+	http10 bool
+	// status, header and buf hold a buffered response until it is
+	// committed by Flush, Finish or overflowing the buffer
+	status StatusCode
+	header *headers.Headers
+	buf []byte
+	bufferSize int
+	// written counts the body bytes sent so far
+	written int64
+	// err is the first error returned by writer
+	err error
 }
 
 func NewWriter(w io.Writer) *Writer {
 	return &Writer{
 		writer: w,
+		state: stateStatusLine,
 		chunked: false,
+		keepAlive: true,
+		bufferSize: DefaultBufferSize,
+	}
+}
+
+// SetKeepAlive tells the writer whether the connection may be reused after
+// this response. When it may not, WriteHeaders announces Connection: close.
+func (w *Writer) SetKeepAlive(keepAlive bool) {
+	w.keepAlive = keepAlive
+}
+
+// KeepAlive reports whether the connection can carry another request once
+// this response is complete. It becomes false if the handler asked for the
+// connection to be closed or sent a body without any framing.
+func (w *Writer) KeepAlive() bool {
+	return w.keepAlive
+}
+
+// SetHTTPVersion tells the writer which protocol version the client speaks.
+// An HTTP/1.0 client gets an HTTP/1.0 status line, a close-delimited body
+// where chunked encoding would otherwise be used, and an explicit
+// Connection: keep-alive when the connection is kept open.
+func (w *Writer) SetHTTPVersion(major, minor int) {
+	w.http10 = major == 1 && minor == 0
+}
+
+func (w *Writer) HeadersWritten() bool {
+	return w.state >= stateBody
+}
+
+// Status returns the status code of the response: the one already written,
+// or else the one set with SetStatus, or else 200 OK, which is what an
+// unfinished response is completed with.
+func (w *Writer) Status() StatusCode {
+	if w.status == 0 {
+		return StatusOk
 	}
+	return w.status
 }
 
+// BytesWritten returns the number of body bytes the handler has written,
+// including any still held in the buffer. Chunked encoding framing is not
+// counted.
+func (w *Writer) BytesWritten() int64 {
+	return w.written + int64(len(w.buf))
+}
+
+// WriteStatusLine writes the status line with the registered reason phrase
+// for statusCode. Unregistered three-digit codes are written with an empty
+// reason phrase.
 func (w *Writer) WriteStatusLine(statusCode StatusCode) error {
-	statusLine := []byte{}
-	switch statusCode {
-	case StatusOk:
-		statusLine = []byte("HTTP/1.1 200 OK\r\n")
-	case StatusBadRequest:
-		statusLine = []byte("HTTP/1.1 400 Bad Request\r\n")
-	case StatusNotFound:
-		statusLine = []byte("HTTP/1.1 404 Not Found\r\n")
-	case StatusInternalServerError:
-		statusLine = []byte("HTTP/1.1 500 Internal Server Error\r\n")
-	default:
-		return fmt.Errorf("unrecognized error code")
-	}
-
-	_, err := w.writer.Write(statusLine)
+	return w.WriteStatusLineWithReason(statusCode, StatusText(statusCode))
+}
+
+// WriteStatusLineWithReason writes the status line for any three-digit
+// status code with a caller-supplied reason phrase.
+func (w *Writer) WriteStatusLineWithReason(statusCode StatusCode, reason string) error {
+	if w.state != stateStatusLine {
+		return ERROR_STATUS_ALREADY_WRITTEN
+	}
+	if statusCode < 100 || statusCode > 999 {
+		return ERROR_INVALID_STATUS_CODE
+	}
+	if !validReasonPhrase(reason) {
+		return ERROR_INVALID_REASON_PHRASE
+	}
+
+	version := "HTTP/1.1"
+	if w.http10 {
+		version = "HTTP/1.0"
+	}
+
+	w.state = stateHeaders
+	w.status = statusCode
+	statusLine := fmt.Appendf(nil, "%s %d %s\r\n", version, statusCode, reason)
+	_, err := w.write(statusLine)
 	return err
 }
 
+// WriteHeaders writes the header section. Fields set through Header are
+// sent as well, unless h has fields of the same name. If no status line
+// has been written yet, the one set with SetStatus, or 200 OK, is sent
+// first.
 func (w *Writer) WriteHeaders(h *headers.Headers) error {
+	if w.state > stateHeaders {
+		return ERROR_HEADERS_ALREADY_WRITTEN
+	}
+	w.mergeHeader(h)
+	// refuse before anything is written, so the handler can still send an
+	// error response instead
+	if err := h.Validate(); err != nil {
+		return err
+	}
+	if w.state == stateStatusLine {
+		if err := w.WriteStatusLine(w.Status()); err != nil {
+			return err
+		}
+	}
+
+	if v, ok := h.Get("Connection"); ok && hasToken(v, "close") {
+		w.keepAlive = false
+	}
+
+	if !bodyAllowed(w.status) {
+		// these must not announce a length at all; a 304 may still send
+		// the length of the representation the client already has
+		if w.status != StatusNotModified {
+			h.Remove("Content-Length")
+		}
+		h.Remove("Transfer-Encoding")
+		// nor end in a last chunk
+		w.chunked = false
+	}
+
+	_, hasLength := h.Get("Content-Length")
+	te, _ := h.Get("Transfer-Encoding")
+	if bodyAllowed(w.status) && !hasLength && !hasToken(te, "chunked") {
+		// the body can only be delimited by closing the connection
+		w.keepAlive = false
+	}
+
+	if !w.keepAlive {
+		h.Replace("Connection", "close")
+	} else if w.http10 {
+		h.Replace("Connection", "keep-alive")
+	}
+
+	w.state = stateBody
 	b := []byte{}
 	h.ForEach(func(n, v string) {
 		b = fmt.Appendf(b, "%s: %s\r\n", n, v)
 	})
 	b = fmt.Appendf(b, "\r\n")
-	_, err := w.writer.Write(b)
+	_, err := w.write(b)
 	return err
 }
 
+// mergeHeader adds the fields set through Header to h, except those h sets
+// itself. The framing of the body is left to h alone.
+func (w *Writer) mergeHeader(h *headers.Headers) {
+	if w.header == nil || w.header == h {
+		return
+	}
+
+	own := map[string]bool{
+		"content-length": true,
+		"transfer-encoding": true,
+	}
+	h.ForEach(func(n, v string) {
+		own[strings.ToLower(n)] = true
+	})
+	w.header.ForEach(func(n, v string) {
+		if !own[strings.ToLower(n)] {
+			h.Add(n, v)
+		}
+	})
+}
+
+// ensureHeaders lets a handler start on the body right away: whatever part
+// of the status line and header section is missing is committed from
+// SetStatus and Header, using chunked encoding unless Header sets a
+// Content-Length.
+func (w *Writer) ensureHeaders() error {
+	if w.state == stateFinished {
+		return ERROR_RESPONSE_FINISHED
+	}
+	if w.state == stateBody {
+		return nil
+	}
+	return w.commit(false)
+}
+
 func (w *Writer) WriteBody(data []byte) (int, error) {
+	if err := w.ensureHeaders(); err != nil {
+		return 0, err
+	}
+	if !bodyAllowed(w.status) {
+		return 0, ERROR_BODY_NOT_ALLOWED
+	}
+
 	if w.chunked {
 		return w.WriteChunk(data)
 	}
-	n, err := w.writer.Write(data)
+	n, err := w.write(data)
+	w.written += int64(n)
 	return n, err
 }
 
+// EnableChunkedEncoding switches the response to a body of unknown length.
+// HTTP/1.0 clients do not understand chunked encoding, so for them the
+// body is sent as is and ended by closing the connection.
+func (w *Writer) EnableChunkedEncoding(h *headers.Headers) error {
+	if w.state > stateHeaders {
+		return ERROR_HEADERS_ALREADY_WRITTEN
+	}
 
-func (w *Writer) EnableChunkedEncoding(h *headers.Headers) {
 	w.chunked = true
-	h.Replace("Transfer-Encoding", "chunked")
 	h.Remove("Content-Length")
+	if w.http10 {
+		h.Remove("Transfer-Encoding")
+		w.keepAlive = false
+	} else {
+		h.Replace("Transfer-Encoding", "chunked")
+	}
+	return nil
 }
 
-
 func (w *Writer) WriteChunk(data []byte) (int, error) {
+	if !w.chunked {
+		return 0, ERROR_CHUNKED_NOT_ENABLED
+	}
+	if err := w.ensureHeaders(); err != nil {
+		return 0, err
+	}
+
 	if len(data) == 0 {
 		return 0, nil
 	}
 
+	if w.http10 {
+		n, err := w.write(data)
+		w.written += int64(n)
+		return n, err
+	}
+
 	sizeHex := strconv.FormatInt(int64(len(data)), 16)
 	chunk := fmt.Sprintf("%s\r\n", sizeHex)
 	
-	_, err := w.writer.Write([]byte(chunk))
+	_, err := w.write([]byte(chunk))
 	if err != nil {
 		return 0, err
 	}
 
-	n, err := w.writer.Write(data)
+	n, err := w.write(data)
+	w.written += int64(n)
 	if err != nil {
 		return n, err
 	}
 
-	_, err = w.writer.Write([]byte("\r\n"))
+	_, err = w.write([]byte("\r\n"))
 	if err != nil {
 		return n, err
 	}
@@ -103,18 +308,181 @@ func (w *Writer) WriteChunk(data []byte) (int, error) {
 	return n, nil
 }
 
+// FinalizeChunkedEncoding ends a chunked body with the last chunk. A
+// response whose status allows no body was sent without chunked encoding,
+// so it is only marked finished.
 func (w *Writer) FinalizeChunkedEncoding() error {
+	if w.state == stateBody && !bodyAllowed(w.status) {
+		w.state = stateFinished
+		return nil
+	}
 	if !w.chunked {
-		return fmt.Errorf("chunked encoding not enabled")
+		return ERROR_CHUNKED_NOT_ENABLED
 	}
-	_, err := w.writer.Write([]byte("0\r\n\r\n"))
+	if err := w.ensureHeaders(); err != nil {
+		return err
+	}
+
+	w.state = stateFinished
+	if w.http10 {
+		return nil
+	}
+	_, err := w.write([]byte("0\r\n\r\n"))
 	return err
 }
 
+// Finish completes the response once the handler has returned. A handler
+// that wrote nothing gets an empty 200 OK, a missing header section is sent
+// with Content-Length: 0, and an open chunked body is terminated.
+func (w *Writer) Finish() error {
+	if w.state == stateFinished {
+		return nil
+	}
+	if w.state < stateBody && !w.chunked {
+		// the whole body, if any, is buffered: its length is known
+		if err := w.commit(true); err != nil {
+			return err
+		}
+	}
+	if w.chunked {
+		return w.FinalizeChunkedEncoding()
+	}
+
+	w.state = stateFinished
+	return nil
+}
+
+// Header returns the headers sent with the response, whether it is
+// committed from the buffer or by WriteHeaders. Changes made after the
+// header section is written have no effect.
+func (w *Writer) Header() *headers.Headers {
+	if w.header == nil {
+		w.header = headers.NewHeaders()
+	}
+	return w.header
+}
+
+// SetStatus sets the status code sent when no status line is written
+// explicitly. The default is 200 OK.
+func (w *Writer) SetStatus(statusCode StatusCode) error {
+	if w.state != stateStatusLine {
+		return ERROR_STATUS_ALREADY_WRITTEN
+	}
+	w.status = statusCode
+	return nil
+}
+
+// Reset drops the status, Header and body buffered so far, so that a
+// different response can be sent instead. It fails once any part of the
+// response has been written.
+func (w *Writer) Reset() error {
+	if w.state != stateStatusLine {
+		return ERROR_STATUS_ALREADY_WRITTEN
+	}
+	w.status = 0
+	w.header = nil
+	w.buf = nil
+	w.chunked = false
+	return nil
+}
+
+// SetBufferSize changes how many body bytes Write holds back before
+// switching to chunked encoding. It must be called before the first Write.
+func (w *Writer) SetBufferSize(size int) {
+	w.bufferSize = size
+}
+
+// Write buffers body bytes so that the response can be sent with a
+// Content-Length. Once the buffer would overflow, the status line and
+// Header are committed with chunked encoding, unless the handler set its
+// own Content-Length, and the body is streamed from then on. After the
+// header section has been written, Write behaves like WriteBody.
+func (w *Writer) Write(data []byte) (int, error) {
+	if w.state >= stateBody {
+		return w.WriteBody(data)
+	}
+	if !bodyAllowed(w.Status()) && len(data) > 0 {
+		return 0, ERROR_BODY_NOT_ALLOWED
+	}
+
+	if len(w.buf) + len(data) <= w.bufferSize {
+		w.buf = append(w.buf, data...)
+		return len(data), nil
+	}
+
+	if err := w.commit(false); err != nil {
+		return 0, err
+	}
+	return w.WriteBody(data)
+}
+
+// Flush commits a buffered response and sends what has been written so
+// far. The rest of the body is sent with chunked encoding.
+func (w *Writer) Flush() error {
+	if w.state >= stateBody {
+		return w.err
+	}
+	return w.commit(false)
+}
+
+// commit writes the status line, the Header and any buffered body. When
+// final is set the buffer holds the whole body and its length is sent as
+// Content-Length; otherwise more body may follow. Responses whose status
+// allows no body get neither framing nor body.
+func (w *Writer) commit(final bool) error {
+	h := w.Header()
+	status := w.Status()
+
+	if !bodyAllowed(status) {
+		// a body written before the status was set is dropped
+		w.buf = nil
+	} else {
+		if _, ok := h.Get("Content-Type"); !ok {
+			h.Set("Content-Type", "text/plain")
+		}
+
+		_, hasLength := h.Get("Content-Length")
+		if final {
+			h.Replace("Content-Length", strconv.Itoa(len(w.buf)))
+		} else if !hasLength {
+			if err := w.EnableChunkedEncoding(h); err != nil {
+				return err
+			}
+		}
+	}
+
+	// the status line goes out with the header section, once it has been
+	// validated
+	if err := w.WriteHeaders(h); err != nil {
+		return err
+	}
+
+	body := w.buf
+	w.buf = nil
+	if len(body) == 0 {
+		return nil
+	}
+	_, err := w.WriteBody(body)
+	return err
+}
+
+// write sends p to the connection. Once a write has failed every later one
+// fails with the same error, so that a handler streaming to a client that
+// has gone away stops at its next write.
+func (w *Writer) write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	n, err := w.writer.Write(p)
+	if err != nil {
+		w.err = err
+	}
+	return n, err
+}
+
 func GetDefaultHeaders(contentLen int) *headers.Headers {
 	h := headers.NewHeaders()
-	h.Set("Content-length", fmt.Sprintf("%d",contentLen))
-	h.Set("Connection", "close")
+	h.Set("Content-Length", fmt.Sprintf("%d",contentLen))
 	h.Set("Content-Type", "text/plain")
 	return h
 }
@@ -122,7 +490,15 @@ func GetDefaultHeaders(contentLen int) *headers.Headers {
 func GetDefaultHeadersChunked() *headers.Headers {
 	h := headers.NewHeaders()
 	h.Set("Transfer-Encoding", "chunked")
-	h.Set("Connection", "close")
 	h.Set("Content-Type", "text/plain")
 	return h
-}
\ No newline at end of file
+}
+
+func hasToken(value, token string) bool {
+	for _, t := range strings.Split(value, ",") {
+		if strings.EqualFold(strings.TrimSpace(t), token) {
+			return true
+		}
+	}
+	return false
+}
@@ -2,6 +2,9 @@ package response
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
+	"strings"
 	"testing"
 
 	"github.com/reche13/http-from-scratch/internal/headers"
@@ -18,6 +21,16 @@ func TestWriteStatusLine(t *testing.T) {
 			statusCode: StatusOk,
 			want:       "HTTP/1.1 200 OK\r\n",
 		},
+		{
+			name:       "201 Created",
+			statusCode: StatusCreated,
+			want:       "HTTP/1.1 201 Created\r\n",
+		},
+		{
+			name:       "304 Not Modified",
+			statusCode: StatusNotModified,
+			want:       "HTTP/1.1 304 Not Modified\r\n",
+		},
 		{
 			name:       "400 Bad Request",
 			statusCode: StatusBadRequest,
@@ -28,11 +41,41 @@ func TestWriteStatusLine(t *testing.T) {
 			statusCode: StatusNotFound,
 			want:       "HTTP/1.1 404 Not Found\r\n",
 		},
+		{
+			name:       "408 Request Timeout",
+			statusCode: StatusRequestTimeout,
+			want:       "HTTP/1.1 408 Request Timeout\r\n",
+		},
+		{
+			name:       "413 Content Too Large",
+			statusCode: StatusContentTooLarge,
+			want:       "HTTP/1.1 413 Content Too Large\r\n",
+		},
+		{
+			name:       "414 URI Too Long",
+			statusCode: StatusURITooLong,
+			want:       "HTTP/1.1 414 URI Too Long\r\n",
+		},
+		{
+			name:       "431 Request Header Fields Too Large",
+			statusCode: StatusRequestHeaderFieldsTooLarge,
+			want:       "HTTP/1.1 431 Request Header Fields Too Large\r\n",
+		},
 		{
 			name:       "500 Internal Server Error",
 			statusCode: StatusInternalServerError,
 			want:       "HTTP/1.1 500 Internal Server Error\r\n",
 		},
+		{
+			name:       "503 Service Unavailable",
+			statusCode: StatusServiceUnavailable,
+			want:       "HTTP/1.1 503 Service Unavailable\r\n",
+		},
+		{
+			name:       "unregistered code",
+			statusCode: 599,
+			want:       "HTTP/1.1 599 \r\n",
+		},
 	}
 
 	for _, tt := range tests {
@@ -52,6 +95,77 @@ func TestWriteStatusLine(t *testing.T) {
 	}
 }
 
+func TestWriteStatusLineWithReason(t *testing.T) {
+	tests := []struct {
+		name       string
+		statusCode StatusCode
+		reason     string
+		want       string
+		wantErr    error
+	}{
+		{
+			name:       "custom reason",
+			statusCode: StatusOk,
+			reason:     "Everything Is Fine",
+			want:       "HTTP/1.1 200 Everything Is Fine\r\n",
+		},
+		{
+			name:       "unregistered code",
+			statusCode: 299,
+			reason:     "Custom",
+			want:       "HTTP/1.1 299 Custom\r\n",
+		},
+		{
+			name:       "empty reason",
+			statusCode: StatusNoContent,
+			want:       "HTTP/1.1 204 \r\n",
+		},
+		{
+			name:       "two-digit code",
+			statusCode: 99,
+			reason:     "Too Small",
+			wantErr:    ERROR_INVALID_STATUS_CODE,
+		},
+		{
+			name:       "four-digit code",
+			statusCode: 1000,
+			reason:     "Too Big",
+			wantErr:    ERROR_INVALID_STATUS_CODE,
+		},
+		{
+			name:       "reason with CRLF",
+			statusCode: StatusOk,
+			reason:     "OK\r\nSet-Cookie: x=y",
+			wantErr:    ERROR_INVALID_REASON_PHRASE,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			w := NewWriter(&buf)
+
+			err := w.WriteStatusLineWithReason(tt.statusCode, tt.reason)
+			if err != tt.wantErr {
+				t.Fatalf("error: got %v, want %v", err, tt.wantErr)
+			}
+
+			if buf.String() != tt.want {
+				t.Fatalf("got %q, want %q", buf.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestStatusText(t *testing.T) {
+	if got := StatusText(StatusTooManyRequests); got != "Too Many Requests" {
+		t.Fatalf("got %q, want %q", got, "Too Many Requests")
+	}
+	if got := StatusText(599); got != "" {
+		t.Fatalf("unregistered code: got %q, want empty", got)
+	}
+}
+
 func TestWriteHeaders(t *testing.T) {
 	var buf bytes.Buffer
 	w := NewWriter(&buf)
@@ -60,13 +174,18 @@ func TestWriteHeaders(t *testing.T) {
 	h.Set("Content-Type", "text/html")
 	h.Set("Content-Length", "42")
 
+	if err := w.WriteStatusLine(StatusOk); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	buf.Reset()
+
 	err := w.WriteHeaders(h)
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
 
 	output := buf.String()
-	expected := "content-type: text/html\r\ncontent-length: 42\r\n\r\n"
+	expected := "Content-Type: text/html\r\nContent-Length: 42\r\n\r\n"
 	if output != expected {
 		t.Fatalf("expected headers %s, got %s", expected, output)
 	}
@@ -77,6 +196,10 @@ func TestWriteBody(t *testing.T) {
 	w := NewWriter(&buf)
 
 	data := []byte("Hello World")
+	w.WriteStatusLine(StatusOk)
+	w.WriteHeaders(GetDefaultHeaders(len(data)))
+	buf.Reset()
+
 	n, err := w.WriteBody(data)
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
@@ -99,9 +222,8 @@ func TestGetDefaultHeaders(t *testing.T) {
 		t.Fatalf("content-length: got %q, want %q", contentLen, "100")
 	}
 
-	conn, _ := h.Get("connection")
-	if conn != "close" {
-		t.Fatalf("connection: got %q, want %q", conn, "close")
+	if conn, ok := h.Get("connection"); ok {
+		t.Fatalf("connection: got %q, want no header", conn)
 	}
 
 	contentType, _ := h.Get("content-type")
@@ -147,9 +269,712 @@ func TestChunkedResponse(t *testing.T) {
 	}
 
 	output := buf.String()
-	expected := "HTTP/1.1 200 OK\r\ntransfer-encoding: chunked\r\nconnection: close\r\ncontent-type: text/plain\r\n\r\n5\r\nHello\r\n6\r\n World\r\n0\r\n\r\n"
+	expected := "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\nContent-Type: text/plain\r\n\r\n5\r\nHello\r\n6\r\n World\r\n0\r\n\r\n"
 	if output != expected {
 		t.Fatalf("got %q, want %q", output, expected)
 	}
 }
 
+func TestWriteHeadersConnectionClose(t *testing.T) {
+	tests := []struct {
+		name          string
+		keepAlive     bool
+		headers       map[string]string
+		wantKeepAlive bool
+	}{
+		{
+			name:          "keep-alive with content-length",
+			keepAlive:     true,
+			headers:       map[string]string{"Content-Length": "0"},
+			wantKeepAlive: true,
+		},
+		{
+			name:          "server asked to close",
+			keepAlive:     false,
+			headers:       map[string]string{"Content-Length": "0"},
+			wantKeepAlive: false,
+		},
+		{
+			name:          "handler asked to close",
+			keepAlive:     true,
+			headers:       map[string]string{"Content-Length": "0", "Connection": "close"},
+			wantKeepAlive: false,
+		},
+		{
+			name:          "no body framing",
+			keepAlive:     true,
+			headers:       map[string]string{"Content-Type": "text/plain"},
+			wantKeepAlive: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			w := NewWriter(&buf)
+			w.SetKeepAlive(tt.keepAlive)
+
+			h := headers.NewHeaders()
+			for k, v := range tt.headers {
+				h.Set(k, v)
+			}
+
+			if err := w.WriteHeaders(h); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if w.KeepAlive() != tt.wantKeepAlive {
+				t.Fatalf("keep-alive: got %v, want %v", w.KeepAlive(), tt.wantKeepAlive)
+			}
+
+			conn, _ := h.Get("connection")
+			if !tt.wantKeepAlive && conn != "close" {
+				t.Fatalf("connection: got %q, want %q", conn, "close")
+			}
+		})
+	}
+}
+
+func TestWriterOrdering(t *testing.T) {
+	tests := []struct {
+		name    string
+		write   func(w *Writer) error
+		wantErr error
+	}{
+		{
+			name: "status line twice",
+			write: func(w *Writer) error {
+				w.WriteStatusLine(StatusOk)
+				return w.WriteStatusLine(StatusNotFound)
+			},
+			wantErr: ERROR_STATUS_ALREADY_WRITTEN,
+		},
+		{
+			name: "status line after headers",
+			write: func(w *Writer) error {
+				w.WriteStatusLine(StatusOk)
+				w.WriteHeaders(GetDefaultHeaders(0))
+				return w.WriteStatusLine(StatusNotFound)
+			},
+			wantErr: ERROR_STATUS_ALREADY_WRITTEN,
+		},
+		{
+			name: "headers twice",
+			write: func(w *Writer) error {
+				w.WriteStatusLine(StatusOk)
+				w.WriteHeaders(GetDefaultHeaders(0))
+				return w.WriteHeaders(GetDefaultHeaders(0))
+			},
+			wantErr: ERROR_HEADERS_ALREADY_WRITTEN,
+		},
+		{
+			name: "chunked encoding enabled after headers",
+			write: func(w *Writer) error {
+				w.WriteStatusLine(StatusOk)
+				w.WriteHeaders(GetDefaultHeaders(0))
+				return w.EnableChunkedEncoding(headers.NewHeaders())
+			},
+			wantErr: ERROR_HEADERS_ALREADY_WRITTEN,
+		},
+		{
+			name: "chunk without chunked encoding",
+			write: func(w *Writer) error {
+				_, err := w.WriteChunk([]byte("Hello"))
+				return err
+			},
+			wantErr: ERROR_CHUNKED_NOT_ENABLED,
+		},
+		{
+			name: "finalize without chunked encoding",
+			write: func(w *Writer) error {
+				return w.FinalizeChunkedEncoding()
+			},
+			wantErr: ERROR_CHUNKED_NOT_ENABLED,
+		},
+		{
+			name: "body after finalize",
+			write: func(w *Writer) error {
+				w.WriteBody([]byte("Hello"))
+				w.FinalizeChunkedEncoding()
+				_, err := w.WriteBody([]byte("Hello"))
+				return err
+			},
+			wantErr: ERROR_RESPONSE_FINISHED,
+		},
+		{
+			name: "body after finish",
+			write: func(w *Writer) error {
+				w.Finish()
+				_, err := w.WriteBody([]byte("Hello"))
+				return err
+			},
+			wantErr: ERROR_RESPONSE_FINISHED,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			w := NewWriter(&buf)
+
+			if err := tt.write(w); err != tt.wantErr {
+				t.Fatalf("error: got %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestImplicitStatusAndHeaders(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+
+	if _, err := w.WriteBody([]byte("Hello")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := w.Finish(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	output := buf.String()
+	if !strings.HasPrefix(output, "HTTP/1.1 200 OK\r\n") {
+		t.Fatalf("expected implicit 200 status line, got %q", output)
+	}
+	if !strings.Contains(output, "Transfer-Encoding: chunked\r\n") {
+		t.Fatalf("expected implicit chunked encoding, got %q", output)
+	}
+	if !strings.HasSuffix(output, "\r\n\r\n5\r\nHello\r\n0\r\n\r\n") {
+		t.Fatalf("expected chunked body, got %q", output)
+	}
+}
+
+func TestUnbufferedWritesUseStatusAndHeader(t *testing.T) {
+	tests := []struct {
+		name  string
+		write func(w *Writer)
+		want  string
+	}{
+		{
+			name: "WriteBody",
+			write: func(w *Writer) {
+				w.WriteBody([]byte("Hello"))
+			},
+			want: "HTTP/1.1 404 Not Found\r\n" +
+				"X-A: 1\r\nContent-Type: text/html\r\nTransfer-Encoding: chunked\r\n\r\n" +
+				"5\r\nHello\r\n0\r\n\r\n",
+		},
+		{
+			name: "WriteHeaders",
+			write: func(w *Writer) {
+				// the framing is the one WriteHeaders is given
+				w.Header().Set("Content-Length", "99")
+				w.WriteHeaders(GetDefaultHeaders(5))
+				w.WriteBody([]byte("Hello"))
+			},
+			want: "HTTP/1.1 404 Not Found\r\n" +
+				"Content-Length: 5\r\nContent-Type: text/plain\r\nX-A: 1\r\n\r\n" +
+				"Hello",
+		},
+		{
+			name: "WriteHeaders after the status line",
+			write: func(w *Writer) {
+				w.WriteStatusLine(StatusAccepted)
+				w.WriteHeaders(GetDefaultHeaders(0))
+			},
+			want: "HTTP/1.1 202 Accepted\r\n" +
+				"Content-Length: 0\r\nContent-Type: text/plain\r\nX-A: 1\r\n\r\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			w := NewWriter(&buf)
+			// as middleware would before calling the handler
+			w.SetStatus(StatusNotFound)
+			w.Header().Set("X-A", "1")
+			w.Header().Set("Content-Type", "text/html")
+
+			tt.write(w)
+			if err := w.Finish(); err != nil {
+				t.Fatalf("finish: %v", err)
+			}
+			if buf.String() != tt.want {
+				t.Fatalf("got %q, want %q", buf.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestFinishEmptyResponse(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+
+	if err := w.Finish(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	output := buf.String()
+	if !strings.HasPrefix(output, "HTTP/1.1 200 OK\r\n") {
+		t.Fatalf("expected 200 status line, got %q", output)
+	}
+	if !strings.Contains(output, "Content-Length: 0\r\n") {
+		t.Fatalf("expected empty body, got %q", output)
+	}
+}
+
+func TestBufferedWriter(t *testing.T) {
+	tests := []struct {
+		name  string
+		write func(w *Writer)
+		want  []string
+		notWant []string
+		body  string
+	}{
+		{
+			name: "small body gets content-length",
+			write: func(w *Writer) {
+				w.SetStatus(StatusCreated)
+				w.Header().Replace("Content-Type", "text/html")
+				w.Write([]byte("Hello"))
+				w.Write([]byte("!!"))
+			},
+			want: []string{"HTTP/1.1 201 Created\r\n", "Content-Type: text/html\r\n", "Content-Length: 7\r\n"},
+			body: "Hello!!",
+		},
+		{
+			name: "overflow switches to chunked",
+			write: func(w *Writer) {
+				w.Write([]byte("Hello"))
+				w.Write([]byte(" World"))
+			},
+			want: []string{"HTTP/1.1 200 OK\r\n", "Transfer-Encoding: chunked\r\n"},
+			body: "5\r\nHello\r\n6\r\n World\r\n0\r\n\r\n",
+		},
+		{
+			name: "overflow keeps handler content-length",
+			write: func(w *Writer) {
+				w.Header().Replace("Content-Length", "11")
+				w.Write([]byte("Hello"))
+				w.Write([]byte(" World"))
+			},
+			want: []string{"HTTP/1.1 200 OK\r\n", "Content-Length: 11\r\n"},
+			body: "Hello World",
+		},
+		{
+			name: "flush switches to chunked",
+			write: func(w *Writer) {
+				w.Write([]byte("Hi"))
+				w.Flush()
+				w.Write([]byte("!"))
+			},
+			want: []string{"HTTP/1.1 200 OK\r\n", "Transfer-Encoding: chunked\r\n"},
+			body: "2\r\nHi\r\n1\r\n!\r\n0\r\n\r\n",
+		},
+		{
+			name: "no content",
+			write: func(w *Writer) {
+				w.SetStatus(StatusNoContent)
+			},
+			want: []string{"HTTP/1.1 204 No Content\r\n"},
+			notWant: []string{"Content-Length", "Content-Type", "Transfer-Encoding"},
+		},
+		{
+			name: "no content drops framing set by the handler",
+			write: func(w *Writer) {
+				w.Header().Set("Content-Length", "5")
+				w.Write([]byte("Hello"))
+				w.SetStatus(StatusNoContent)
+			},
+			want: []string{"HTTP/1.1 204 No Content\r\n"},
+			notWant: []string{"Content-Length", "Transfer-Encoding"},
+		},
+		{
+			name: "not modified",
+			write: func(w *Writer) {
+				w.SetStatus(StatusNotModified)
+				w.Flush()
+			},
+			want: []string{"HTTP/1.1 304 Not Modified\r\n"},
+			notWant: []string{"Content-Length", "Content-Type", "Transfer-Encoding"},
+		},
+		{
+			name: "not modified keeps representation length",
+			write: func(w *Writer) {
+				w.SetStatus(StatusNotModified)
+				w.Header().Set("Content-Length", "1234")
+			},
+			want: []string{"HTTP/1.1 304 Not Modified\r\n", "Content-Length: 1234\r\n"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			w := NewWriter(&buf)
+			w.SetBufferSize(8)
+
+			tt.write(w)
+			if err := w.Finish(); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			head, body, ok := strings.Cut(buf.String(), "\r\n\r\n")
+			if !ok {
+				t.Fatalf("no end of header section in %q", buf.String())
+			}
+			head += "\r\n"
+
+			for _, want := range tt.want {
+				if !strings.Contains(head, want) {
+					t.Fatalf("expected %q in %q", want, head)
+				}
+			}
+			for _, notWant := range tt.notWant {
+				if strings.Contains(head, notWant) {
+					t.Fatalf("unexpected %q in %q", notWant, head)
+				}
+			}
+			if body != tt.body {
+				t.Fatalf("body: got %q, want %q", body, tt.body)
+			}
+		})
+	}
+}
+
+func TestSetStatusAfterCommit(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+
+	w.Write([]byte("Hello"))
+	w.Flush()
+
+	if err := w.SetStatus(StatusNotFound); err != ERROR_STATUS_ALREADY_WRITTEN {
+		t.Fatalf("error: got %v, want %v", err, ERROR_STATUS_ALREADY_WRITTEN)
+	}
+}
+
+func TestWriteHeadersKeepsRepeatedFields(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+
+	h := GetDefaultHeaders(0)
+	h.Add("Set-Cookie", "a=1; Expires=Wed, 21 Oct 2015 07:28:00 GMT")
+	h.Add("Set-Cookie", "b=2")
+
+	w.WriteStatusLine(StatusOk)
+	buf.Reset()
+	if err := w.WriteHeaders(h); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := "Content-Length: 0\r\nContent-Type: text/plain\r\n" +
+		"Set-Cookie: a=1; Expires=Wed, 21 Oct 2015 07:28:00 GMT\r\n" +
+		"Set-Cookie: b=2\r\n\r\n"
+	if buf.String() != expected {
+		t.Fatalf("got %q, want %q", buf.String(), expected)
+	}
+}
+
+func TestWriteHeadersRejectsInjection(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+
+	h := GetDefaultHeaders(0)
+	h.Replace("Location", "/next\r\nSet-Cookie: evil=1")
+
+	err := w.WriteHeaders(h)
+	if !errors.Is(err, headers.ERROR_MALFORMED_FIELD_VALUE) {
+		t.Fatalf("error: got %v, want %v", err, headers.ERROR_MALFORMED_FIELD_VALUE)
+	}
+	if buf.Len() != 0 {
+		t.Fatalf("nothing should be written, got %q", buf.String())
+	}
+
+	// the handler can still send a proper response
+	w.WriteStatusLine(StatusInternalServerError)
+	if err := w.WriteHeaders(GetDefaultHeaders(0)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// nor is anything written when a buffered response is committed
+	for _, commit := range []func(w *Writer) error{(*Writer).Flush, (*Writer).Finish} {
+		buf.Reset()
+		w = NewWriter(&buf)
+		w.Header().Set("X-Echo", "a\r\nSet-Cookie: evil=1")
+		w.Write([]byte("Hello"))
+
+		if err := commit(w); !errors.Is(err, headers.ERROR_MALFORMED_FIELD_VALUE) {
+			t.Fatalf("error: got %v, want %v", err, headers.ERROR_MALFORMED_FIELD_VALUE)
+		}
+		if buf.Len() != 0 {
+			t.Fatalf("nothing should be written, got %q", buf.String())
+		}
+		if err := w.Reset(); err != nil {
+			t.Fatalf("reset: %v", err)
+		}
+	}
+}
+
+func TestHTTP10Response(t *testing.T) {
+	tests := []struct {
+		name          string
+		keepAlive     bool
+		write         func(w *Writer)
+		want          string
+		wantKeepAlive bool
+	}{
+		{
+			name: "content-length body",
+			write: func(w *Writer) {
+				w.Write([]byte("Hello"))
+			},
+			want: "HTTP/1.0 200 OK\r\nContent-Type: text/plain\r\nContent-Length: 5\r\nConnection: close\r\n\r\nHello",
+		},
+		{
+			name:      "keep-alive is announced",
+			keepAlive: true,
+			write: func(w *Writer) {
+				w.Write([]byte("Hello"))
+			},
+			want:          "HTTP/1.0 200 OK\r\nContent-Type: text/plain\r\nContent-Length: 5\r\nConnection: keep-alive\r\n\r\nHello",
+			wantKeepAlive: true,
+		},
+		{
+			name:      "no chunked encoding",
+			keepAlive: true,
+			write: func(w *Writer) {
+				h := GetDefaultHeadersChunked()
+				w.EnableChunkedEncoding(h)
+				w.WriteStatusLine(StatusOk)
+				w.WriteHeaders(h)
+				w.WriteChunk([]byte("Hello"))
+				w.WriteChunk([]byte(" World"))
+				w.FinalizeChunkedEncoding()
+			},
+			want: "HTTP/1.0 200 OK\r\nContent-Type: text/plain\r\nConnection: close\r\n\r\nHello World",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			w := NewWriter(&buf)
+			w.SetHTTPVersion(1, 0)
+			w.SetKeepAlive(tt.keepAlive)
+
+			tt.write(w)
+			if err := w.Finish(); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if buf.String() != tt.want {
+				t.Fatalf("got %q, want %q", buf.String(), tt.want)
+			}
+			if w.KeepAlive() != tt.wantKeepAlive {
+				t.Fatalf("keep-alive: got %v, want %v", w.KeepAlive(), tt.wantKeepAlive)
+			}
+		})
+	}
+}
+
+func TestStatusAndBytesWritten(t *testing.T) {
+	tests := []struct {
+		name string
+		write func(w *Writer)
+		status StatusCode
+		bytes int64
+	}{
+		{
+			name: "nothing written",
+			write: func(w *Writer) {},
+			status: StatusOk,
+			bytes: 0,
+		},
+		{
+			name: "buffered",
+			write: func(w *Writer) {
+				w.SetStatus(StatusCreated)
+				w.Write([]byte("hello"))
+			},
+			status: StatusCreated,
+			bytes: 5,
+		},
+		{
+			name: "flushed",
+			write: func(w *Writer) {
+				w.SetStatus(StatusAccepted)
+				w.Write([]byte("hello"))
+				w.Flush()
+				w.Write([]byte(" world"))
+			},
+			status: StatusAccepted,
+			bytes: 11,
+		},
+		{
+			name: "explicit status line and body",
+			write: func(w *Writer) {
+				w.WriteStatusLine(StatusNotFound)
+				w.WriteHeaders(GetDefaultHeaders(3))
+				w.WriteBody([]byte("abc"))
+			},
+			status: StatusNotFound,
+			bytes: 3,
+		},
+		{
+			name: "implicit chunked body",
+			write: func(w *Writer) {
+				w.WriteBody([]byte("ab"))
+				w.WriteBody([]byte("cde"))
+			},
+			status: StatusOk,
+			bytes: 5,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			w := NewWriter(&buf)
+			tt.write(w)
+
+			if got := w.Status(); got != tt.status {
+				t.Fatalf("status: got %d, want %d", got, tt.status)
+			}
+			if got := w.BytesWritten(); got != tt.bytes {
+				t.Fatalf("bytes: got %d, want %d", got, tt.bytes)
+			}
+
+			// finishing the response does not change the counts
+			w.Finish()
+			if got := w.BytesWritten(); got != tt.bytes {
+				t.Fatalf("bytes after Finish: got %d, want %d", got, tt.bytes)
+			}
+		})
+	}
+}
+
+func TestReset(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.SetStatus(StatusCreated)
+	w.Header().Set("X-Dropped", "1")
+	w.Write([]byte("dropped"))
+
+	if err := w.Reset(); err != nil {
+		t.Fatalf("reset: %v", err)
+	}
+	w.SetStatus(StatusInternalServerError)
+	w.Finish()
+
+	want := "HTTP/1.1 500 Internal Server Error\r\nContent-Type: text/plain\r\nContent-Length: 0\r\n\r\n"
+	if buf.String() != want {
+		t.Fatalf("got %q, want %q", buf.String(), want)
+	}
+
+	w = NewWriter(&buf)
+	w.Write([]byte("sent"))
+	w.Flush()
+	if err := w.Reset(); err != ERROR_STATUS_ALREADY_WRITTEN {
+		t.Fatalf("reset after flush: got %v, want %v", err, ERROR_STATUS_ALREADY_WRITTEN)
+	}
+}
+
+// failingWriter accepts limit bytes and then fails.
+type failingWriter struct {
+	limit int
+	writes int
+}
+
+func (f *failingWriter) Write(p []byte) (int, error) {
+	f.writes++
+	if len(p) > f.limit {
+		n := f.limit
+		f.limit = 0
+		return n, errors.New("connection closed")
+	}
+	f.limit -= len(p)
+	return len(p), nil
+}
+
+func TestWriteErrorIsSticky(t *testing.T) {
+	fw := &failingWriter{limit: 256}
+	w := NewWriter(fw)
+	w.Write([]byte("hello"))
+	if err := w.Flush(); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+
+	var firstErr error
+	for i := 0; i < 20 && firstErr == nil; i++ {
+		_, firstErr = w.Write([]byte(strings.Repeat("x", 32)))
+	}
+	if firstErr == nil {
+		t.Fatalf("write did not fail")
+	}
+
+	writes := fw.writes
+	if _, err := w.Write([]byte("more")); err != firstErr {
+		t.Fatalf("write after failure: got %v, want %v", err, firstErr)
+	}
+	if err := w.Flush(); err != firstErr {
+		t.Fatalf("flush after failure: got %v, want %v", err, firstErr)
+	}
+	if err := w.Finish(); err != firstErr {
+		t.Fatalf("finish after failure: got %v, want %v", err, firstErr)
+	}
+	if fw.writes != writes {
+		t.Fatalf("writer was used after it failed")
+	}
+}
+
+func TestBodyNotAllowed(t *testing.T) {
+	for _, status := range []StatusCode{StatusContinue, StatusNoContent, StatusNotModified} {
+		var buf bytes.Buffer
+		w := NewWriter(&buf)
+		w.SetStatus(status)
+		if _, err := w.Write([]byte("x")); err != ERROR_BODY_NOT_ALLOWED {
+			t.Fatalf("%d: Write: got %v, want %v", status, err, ERROR_BODY_NOT_ALLOWED)
+		}
+
+		w = NewWriter(&buf)
+		w.WriteStatusLine(status)
+		if _, err := w.WriteBody([]byte("x")); err != ERROR_BODY_NOT_ALLOWED {
+			t.Fatalf("%d: WriteBody: got %v, want %v", status, err, ERROR_BODY_NOT_ALLOWED)
+		}
+	}
+
+	// a bodiless response leaves the connection usable
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.WriteStatusLine(StatusNoContent)
+	w.WriteHeaders(GetDefaultHeaders(0))
+	if !w.KeepAlive() {
+		t.Fatalf("204 without framing should keep the connection alive")
+	}
+	if want := "HTTP/1.1 204 No Content\r\nContent-Type: text/plain\r\n\r\n"; buf.String() != want {
+		t.Fatalf("got %q, want %q", buf.String(), want)
+	}
+
+	// nor does one set up for streaming
+	for _, status := range []StatusCode{StatusContinue, StatusNoContent, StatusNotModified} {
+		buf.Reset()
+		w = NewWriter(&buf)
+		h := GetDefaultHeaders(0)
+		w.EnableChunkedEncoding(h)
+		w.WriteStatusLine(status)
+		w.WriteHeaders(h)
+		if err := w.FinalizeChunkedEncoding(); err != nil {
+			t.Fatalf("%d: finalize: %v", status, err)
+		}
+		if err := w.Finish(); err != nil {
+			t.Fatalf("%d: finish: %v", status, err)
+		}
+		want := fmt.Sprintf("HTTP/1.1 %d %s\r\nContent-Type: text/plain\r\n\r\n", status, StatusText(status))
+		if buf.String() != want {
+			t.Fatalf("%d: got %q, want %q", status, buf.String(), want)
+		}
+		if !w.KeepAlive() {
+			t.Fatalf("%d: connection should be kept alive", status)
+		}
+	}
+}
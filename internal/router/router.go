@@ -0,0 +1,101 @@
+// Package router dispatches requests to handlers by method and path
+// pattern.
+package router
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/reche13/http-from-scratch/internal/request"
+	"github.com/reche13/http-from-scratch/internal/response"
+	"github.com/reche13/http-from-scratch/internal/server"
+)
+
+// Router matches the path of each request against registered patterns.
+// A pattern is a path whose segments may be parameters, such as
+// /users/{id}, or end in a wildcard that captures the rest of the path,
+// such as /static/{path...}. Captured values are available from
+// Request.PathValue.
+//
+// When patterns match the path but none of them is registered for the
+// request's method, the router answers 405 Method Not Allowed with an Allow
+// header listing the methods they are registered for.
+type Router struct {
+	// NotFound handles requests that match no pattern. The default answers
+	// 404 Not Found.
+	NotFound server.Handler
+	root node
+}
+
+func New() *Router {
+	return &Router{}
+}
+
+// Handle registers handler for requests with the given method whose path
+// matches pattern. It panics if the pattern is malformed or the method and
+// pattern are already registered, as both are programming errors.
+func (rt *Router) Handle(method, pattern string, handler server.Handler) {
+	if method == "" {
+		panic(fmt.Sprintf("router: pattern %q registered without a method", pattern))
+	}
+
+	tokens, err := parsePattern(pattern)
+	if err != nil {
+		panic("router: " + err.Error())
+	}
+	n, err := rt.root.insert(pattern, tokens)
+	if err != nil {
+		panic("router: " + err.Error())
+	}
+
+	if n.handlers == nil {
+		n.handlers = make(map[string]server.Handler)
+	}
+	if _, ok := n.handlers[method]; ok {
+		panic(fmt.Sprintf("router: %s %s is already registered", method, pattern))
+	}
+	n.handlers[method] = handler
+}
+
+// Serve routes r to its handler. It has the signature of server.Handler, so
+// rt.Serve can be passed to server.New.
+func (rt *Router) Serve(w *response.Writer, r *request.Request) {
+	var params []param
+	allow := make(map[string]struct{})
+	n := rt.root.lookup(r.Target.Path, r.RequestLine.Method, &params, allow)
+	if n == nil {
+		if len(allow) > 0 {
+			methodNotAllowed(w, allow)
+		} else {
+			rt.notFound(w, r)
+		}
+		return
+	}
+
+	for _, p := range params {
+		r.SetPathValue(p.name, p.value)
+	}
+	n.handlers[r.RequestLine.Method](w, r)
+}
+
+func (rt *Router) notFound(w *response.Writer, r *request.Request) {
+	if rt.NotFound != nil {
+		rt.NotFound(w, r)
+		return
+	}
+	w.SetStatus(response.StatusNotFound)
+}
+
+// methodNotAllowed answers a request whose path matches routes for other
+// methods only, listing those methods in the Allow header.
+func methodNotAllowed(w *response.Writer, allow map[string]struct{}) {
+	methods := make([]string, 0, len(allow))
+	for m := range allow {
+		methods = append(methods, m)
+	}
+	sort.Strings(methods)
+
+	w.SetStatus(response.StatusMethodNotAllowed)
+	w.Header().Replace("Allow", strings.Join(methods, ", "))
+}
@@ -0,0 +1,220 @@
+package router
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/reche13/http-from-scratch/internal/request"
+	"github.com/reche13/http-from-scratch/internal/response"
+)
+
+// serve routes a request for method and path through rt and
+// returns the response.
+func serve(t *testing.T, rt *Router, method, path string) *http.Response {
+	t.Helper()
+	r, err := request.ReadRequest(strings.NewReader(method + " " + path + " HTTP/1.1\r\nHost: x\r\n\r\n"))
+	if err != nil {
+		t.Fatalf("read request: %v", err)
+	}
+
+	var buf bytes.Buffer
+	w := response.NewWriter(&buf)
+	rt.Serve(w, r)
+	if err := w.Finish(); err != nil {
+		t.Fatalf("finish: %v", err)
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(&buf), nil)
+	if err != nil {
+		t.Fatalf("read response: %v", err)
+	}
+	return resp
+}
+
+func body(t *testing.T, resp *http.Response) string {
+	t.Helper()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("reading body: %v", err)
+	}
+	return string(b)
+}
+
+// echo answers with the route name followed by the given path values.
+func echo(name string, params ...string) func(w *response.Writer, r *request.Request) {
+	return func(w *response.Writer, r *request.Request) {
+		out := name
+		for _, p := range params {
+			out += " " + p + "=" + r.PathValue(p)
+		}
+		w.Write([]byte(out))
+	}
+}
+
+func TestRouting(t *testing.T) {
+	rt := New()
+	rt.Handle("GET", "/", echo("root"))
+	rt.Handle("GET", "/users", echo("users"))
+	rt.Handle("GET", "/users/", echo("users-slash"))
+	rt.Handle("GET", "/users/me", echo("me"))
+	rt.Handle("GET", "/users/{id}", echo("user", "id"))
+	rt.Handle("GET", "/users/{id}/posts/{post}", echo("post", "id", "post"))
+	rt.Handle("GET", "/user-agents", echo("agents"))
+	rt.Handle("GET", "/static/{path...}", echo("static", "path"))
+	rt.Handle("GET", "/files/{name}", echo("file", "name"))
+	rt.Handle("GET", "/files/{name}/raw", echo("raw", "name"))
+
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/", "root"},
+		{"/users", "users"},
+		{"/users/", "users-slash"},
+		{"/users/me", "me"},
+		{"/users/42", "user id=42"},
+		{"/users/42/posts/7", "post id=42 post=7"},
+		{"/users/a%20b", "user id=a b"},
+		{"/user-agents", "agents"},
+		{"/static/", "static path="},
+		{"/static/css/site.css", "static path=css/site.css"},
+		{"/files/x", "file name=x"},
+		{"/files/x/raw", "raw name=x"},
+	}
+
+	for _, tt := range tests {
+		resp := serve(t, rt, "GET", tt.path)
+		if resp.StatusCode != 200 {
+			t.Errorf("%s: status %d, want 200", tt.path, resp.StatusCode)
+			continue
+		}
+		if got := body(t, resp); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestNotFound(t *testing.T) {
+	rt := New()
+	rt.Handle("GET", "/users/{id}", echo("user", "id"))
+	rt.Handle("GET", "/static/{path...}", echo("static", "path"))
+
+	for _, path := range []string{"/nope", "/users", "/users/", "/users/42/extra", "/static", "/user"} {
+		if resp := serve(t, rt, "GET", path); resp.StatusCode != 404 {
+			t.Errorf("%s: status %d, want 404", path, resp.StatusCode)
+		}
+	}
+
+	rt.NotFound = echo("custom")
+	resp := serve(t, rt, "GET", "/nope")
+	if got := body(t, resp); got != "custom" {
+		t.Fatalf("custom not found: got %q", got)
+	}
+}
+
+func TestMethodNotAllowed(t *testing.T) {
+	rt := New()
+	rt.Handle("GET", "/users/{id}", echo("get"))
+	rt.Handle("PUT", "/users/{id}", echo("put"))
+	rt.Handle("DELETE", "/users/{id}", echo("delete"))
+
+	resp := serve(t, rt, "PUT", "/users/1")
+	if got := body(t, resp); got != "put" {
+		t.Fatalf("PUT: got %q", got)
+	}
+
+	resp = serve(t, rt, "POST", "/users/1")
+	if resp.StatusCode != 405 {
+		t.Fatalf("status: got %d, want 405", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Allow"); got != "DELETE, GET, PUT" {
+		t.Fatalf("Allow: got %q", got)
+	}
+}
+
+func TestHandlePanics(t *testing.T) {
+	tests := []struct {
+		method string
+		pattern string
+	}{
+		{"GET", "users"},
+		{"GET", "/users/x{id}"},
+		{"GET", "/users/{id"},
+		{"GET", "/users/{}"},
+		{"GET", "/static/{path...}/x"},
+		{"GET", "/a"},
+		{"GET", "/b/{other}"},
+		{"", "/c"},
+	}
+
+	rt := New()
+	rt.Handle("GET", "/a", echo("a"))
+	rt.Handle("GET", "/b/{id}", echo("b"))
+
+	for _, tt := range tests {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("Handle(%q, %q) did not panic", tt.method, tt.pattern)
+				}
+			}()
+			rt.Handle(tt.method, tt.pattern, echo("x"))
+		}()
+	}
+}
+
+func TestMethodBacktracking(t *testing.T) {
+	rt := New()
+	rt.Handle("GET", "/users/new", echo("new form"))
+	rt.Handle("POST", "/users/{id}", echo("update", "id"))
+	rt.Handle("PUT", "/users/{id}/avatar", echo("avatar", "id"))
+	rt.Handle("DELETE", "/users/{rest...}", echo("delete", "rest"))
+
+	tests := []struct {
+		method string
+		path string
+		want string
+	}{
+		{"GET", "/users/new", "new form"},
+		{"POST", "/users/new", "update id=new"},
+		{"POST", "/users/42", "update id=42"},
+		{"DELETE", "/users/new", "delete rest=new"},
+		{"DELETE", "/users/new/avatar", "delete rest=new/avatar"},
+		{"PUT", "/users/new/avatar", "avatar id=new"},
+	}
+
+	for _, tt := range tests {
+		resp := serve(t, rt, tt.method, tt.path)
+		if resp.StatusCode != 200 {
+			t.Errorf("%s %s: status %d, want 200", tt.method, tt.path, resp.StatusCode)
+			continue
+		}
+		if got := body(t, resp); got != tt.want {
+			t.Errorf("%s %s: got %q, want %q", tt.method, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestAllowCollectsAllMatchingRoutes(t *testing.T) {
+	rt := New()
+	rt.Handle("GET", "/users/new", echo("new form"))
+	rt.Handle("POST", "/users/{id}", echo("update", "id"))
+	rt.Handle("DELETE", "/users/{rest...}", echo("delete", "rest"))
+
+	resp := serve(t, rt, "PATCH", "/users/new")
+	if resp.StatusCode != 405 {
+		t.Fatalf("status: got %d, want 405", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Allow"); got != "DELETE, GET, POST" {
+		t.Fatalf("Allow: got %q", got)
+	}
+
+	resp = serve(t, rt, "PATCH", "/users/42/x")
+	if got := resp.Header.Get("Allow"); got != "DELETE" {
+		t.Fatalf("Allow: got %q", got)
+	}
+}
@@ -0,0 +1,229 @@
+package router
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/reche13/http-from-scratch/internal/server"
+)
+
+// node is a node of the radix tree that routes are stored in. Static parts
+// of patterns are compressed into edges labelled with prefix, so that a
+// lookup walks one edge per shared prefix instead of testing every route.
+// A parameter or wildcard segment hangs off the node for the static part in
+// front of it.
+type node struct {
+	prefix string
+	// children have distinct first bytes
+	children []*node
+	param *node
+	wildcard *node
+	// name of the parameter captured by a param or wildcard node
+	name string
+	// handlers is non-nil when a route ends at this node
+	handlers map[string]server.Handler
+}
+
+// token is one piece of a pattern: a static string, or the name of a
+// parameter or wildcard.
+type token struct {
+	static string
+	param string
+	wildcard bool
+}
+
+// parsePattern splits a pattern such as /users/{id}/posts or
+// /static/{path...} into tokens. Parameters must span a whole segment and a
+// wildcard must be the last one.
+func parsePattern(pattern string) ([]token, error) {
+	if pattern == "" || pattern[0] != '/' {
+		return nil, fmt.Errorf("pattern %q does not start with /", pattern)
+	}
+
+	var tokens []token
+	var static strings.Builder
+	segments := strings.Split(pattern[1:], "/")
+
+	for i, seg := range segments {
+		static.WriteByte('/')
+		if !strings.HasPrefix(seg, "{") {
+			if strings.ContainsAny(seg, "{}") {
+				return nil, fmt.Errorf("pattern %q: parameter must be a whole segment", pattern)
+			}
+			static.WriteString(seg)
+			continue
+		}
+
+		if !strings.HasSuffix(seg, "}") {
+			return nil, fmt.Errorf("pattern %q: parameter must be a whole segment", pattern)
+		}
+		name := seg[1 : len(seg)-1]
+		name, wildcard := strings.CutSuffix(name, "...")
+		if name == "" || strings.ContainsAny(name, "{}") {
+			return nil, fmt.Errorf("pattern %q: bad parameter name %q", pattern, seg)
+		}
+		if wildcard && i != len(segments)-1 {
+			return nil, fmt.Errorf("pattern %q: wildcard must be the last segment", pattern)
+		}
+
+		tokens = append(tokens, token{static: static.String()})
+		static.Reset()
+		tokens = append(tokens, token{param: name, wildcard: wildcard})
+	}
+
+	if static.Len() > 0 {
+		tokens = append(tokens, token{static: static.String()})
+	}
+	return tokens, nil
+}
+
+// insert adds the route described by tokens below n and returns the node it
+// ends at.
+func (n *node) insert(pattern string, tokens []token) (*node, error) {
+	for _, t := range tokens {
+		switch {
+		case t.static != "":
+			n = n.insertStatic(t.static)
+		case t.wildcard:
+			if n.wildcard == nil {
+				n.wildcard = &node{name: t.param}
+			}
+			if n.wildcard.name != t.param {
+				return nil, fmt.Errorf("pattern %q: wildcard {%s...} conflicts with {%s...}", pattern, t.param, n.wildcard.name)
+			}
+			n = n.wildcard
+		default:
+			if n.param == nil {
+				n.param = &node{name: t.param}
+			}
+			if n.param.name != t.param {
+				return nil, fmt.Errorf("pattern %q: parameter {%s} conflicts with {%s}", pattern, t.param, n.param.name)
+			}
+			n = n.param
+		}
+	}
+	return n, nil
+}
+
+// insertStatic walks or creates the edges spelling s below n, splitting an
+// edge where s diverges from it.
+func (n *node) insertStatic(s string) *node {
+	for s != "" {
+		var child *node
+		for _, c := range n.children {
+			if c.prefix[0] == s[0] {
+				child = c
+				break
+			}
+		}
+		if child == nil {
+			child = &node{prefix: s}
+			n.children = append(n.children, child)
+			return child
+		}
+
+		l := commonPrefix(child.prefix, s)
+		if l < len(child.prefix) {
+			split := &node{
+				prefix: child.prefix[:l],
+				children: []*node{child},
+			}
+			child.prefix = child.prefix[l:]
+			for i, c := range n.children {
+				if c == child {
+					n.children[i] = split
+				}
+			}
+			child = split
+		}
+
+		n = child
+		s = s[l:]
+	}
+	return n
+}
+
+func commonPrefix(a, b string) int {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	return i
+}
+
+// param is a path parameter captured during a lookup.
+type param struct {
+	name string
+	value string
+}
+
+// lookup finds the node of the route matching path, the part of the request
+// path left after n's own prefix, that accepts method. Static edges are
+// preferred over parameters, and parameters over wildcards; when a more
+// specific branch leads nowhere, or only to routes for other methods, the
+// next one is tried. The methods accepted by routes that match the path but
+// not the method are collected in allow.
+func (n *node) lookup(path, method string, params *[]param, allow map[string]struct{}) *node {
+	mark := len(*params)
+
+	if path == "" {
+		if n.match(method, allow) {
+			return n
+		}
+		if n.wildcard != nil {
+			*params = append(*params, param{n.wildcard.name, ""})
+			if n.wildcard.match(method, allow) {
+				return n.wildcard
+			}
+			*params = (*params)[:mark]
+		}
+		return nil
+	}
+
+	for _, c := range n.children {
+		if strings.HasPrefix(path, c.prefix) {
+			if m := c.lookup(path[len(c.prefix):], method, params, allow); m != nil {
+				return m
+			}
+			break
+		}
+	}
+
+	if n.param != nil {
+		end := strings.IndexByte(path, '/')
+		if end == -1 {
+			end = len(path)
+		}
+		if end > 0 {
+			*params = append(*params, param{n.param.name, path[:end]})
+			if m := n.param.lookup(path[end:], method, params, allow); m != nil {
+				return m
+			}
+			*params = (*params)[:mark]
+		}
+	}
+
+	if n.wildcard != nil {
+		*params = append(*params, param{n.wildcard.name, path})
+		if n.wildcard.match(method, allow) {
+			return n.wildcard
+		}
+		*params = (*params)[:mark]
+	}
+	return nil
+}
+
+// match reports whether a route for method ends at n. If routes for other
+// methods end there, their methods are added to allow.
+func (n *node) match(method string, allow map[string]struct{}) bool {
+	if n.handlers == nil {
+		return false
+	}
+	if _, ok := n.handlers[method]; ok {
+		return true
+	}
+	for m := range n.handlers {
+		allow[m] = struct{}{}
+	}
+	return false
+}
@@ -0,0 +1,171 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/reche13/http-from-scratch/internal/request"
+	"github.com/reche13/http-from-scratch/internal/response"
+)
+
+// LogFormat selects how an AccessLog writes its entries.
+type LogFormat int
+
+const (
+	// LogCommon is the Common Log Format:
+	//   host - - [time] "request-line" status bytes
+	LogCommon LogFormat = iota
+	// LogCombined is the Combined Log Format, which adds the Referer and
+	// User-Agent to LogCommon.
+	LogCombined
+	// LogJSON writes one JSON object per request through log/slog, with
+	// every field of AccessEntry.
+	LogJSON
+)
+
+// clfTime is the timestamp layout of the Common and Combined Log Formats.
+const clfTime = "02/Jan/2006:15:04:05 -0700"
+
+// AccessEntry describes one request served, or one that could not be read.
+// In the latter case the request fields are empty.
+type AccessEntry struct {
+	Time time.Time
+	RemoteAddr string
+	Method string
+	Target string
+	Proto string
+	Status response.StatusCode
+	// Bytes is the size of the response body.
+	Bytes int64
+	Duration time.Duration
+	UserAgent string
+	Referer string
+	// RequestID is taken from the client's X-Request-ID header.
+	RequestID string
+}
+
+// AccessLog records the requests a Server has served. The Common and
+// Combined Log Formats are fixed, so duration and request ID are only
+// recorded by LogJSON.
+type AccessLog struct {
+	format LogFormat
+	out io.Writer
+	logger *slog.Logger
+	mu sync.Mutex
+}
+
+func NewAccessLog(out io.Writer, format LogFormat) *AccessLog {
+	return &AccessLog{
+		format: format,
+		out: out,
+		logger: slog.New(slog.NewJSONHandler(out, nil)),
+	}
+}
+
+// Log writes e in the log's format.
+func (l *AccessLog) Log(e AccessEntry) error {
+	if l.format == LogJSON {
+		l.logger.LogAttrs(context.Background(), slog.LevelInfo, "request",
+			slog.String("remote_addr", e.RemoteAddr),
+			slog.String("method", e.Method),
+			slog.String("target", e.Target),
+			slog.String("proto", e.Proto),
+			slog.Int("status", int(e.Status)),
+			slog.Int64("bytes", e.Bytes),
+			slog.Duration("duration", e.Duration),
+			slog.String("user_agent", e.UserAgent),
+			slog.String("referer", e.Referer),
+			slog.String("request_id", e.RequestID),
+		)
+		return nil
+	}
+
+	line := formatCommon(e)
+	if l.format == LogCombined {
+		line += fmt.Sprintf(" %s %s", quoteField(e.Referer), quoteField(e.UserAgent))
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, err := io.WriteString(l.out, line + "\n")
+	return err
+}
+
+// formatCommon formats e in the Common Log Format.
+func formatCommon(e AccessEntry) string {
+	host := e.RemoteAddr
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if host == "" {
+		host = "-"
+	}
+
+	requestLine := "-"
+	if e.Method != "" {
+		requestLine = e.Method + " " + e.Target + " " + e.Proto
+	}
+
+	size := "-"
+	if e.Bytes > 0 {
+		size = strconv.FormatInt(e.Bytes, 10)
+	}
+
+	return fmt.Sprintf("%s - - [%s] %s %d %s", host, e.Time.Format(clfTime), quoteField(requestLine), e.Status, size)
+}
+
+// quoteField quotes a client-supplied value, escaping quotes and control
+// characters so that it cannot forge log lines. An empty value is "-".
+func quoteField(s string) string {
+	if s == "" {
+		s = "-"
+	}
+	b := []byte{'"'}
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		switch {
+		case ch == '"' || ch == '\\':
+			b = append(b, '\\', ch)
+		case ch < 0x20 || ch == 0x7f:
+			b = fmt.Appendf(b, "\\x%02x", ch)
+		default:
+			b = append(b, ch)
+		}
+	}
+	return string(append(b, '"'))
+}
+
+// logAccess records the exchange that started at start, if the server has
+// an AccessLog. r is nil when the request could not be read.
+func (s *Server) logAccess(conn net.Conn, r *request.Request, w *response.Writer, start time.Time) {
+	if s.AccessLog == nil {
+		return
+	}
+
+	e := AccessEntry{
+		Time: start,
+		RemoteAddr: conn.RemoteAddr().String(),
+		Status: w.Status(),
+		Bytes: w.BytesWritten(),
+		Duration: time.Since(start),
+	}
+	if r != nil {
+		e.Method = r.RequestLine.Method
+		e.Target = r.RequestLine.Path
+		e.Proto = r.RequestLine.HttpVersion
+		e.UserAgent, _ = r.Headers.Get("User-Agent")
+		e.Referer, _ = r.Headers.Get("Referer")
+		e.RequestID, _ = r.Headers.Get("X-Request-ID")
+	}
+
+	if err := s.AccessLog.Log(e); err != nil {
+		log.Printf("access log: %v", err)
+	}
+}
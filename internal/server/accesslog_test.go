@@ -0,0 +1,146 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/reche13/http-from-scratch/internal/response"
+)
+
+var testEntry = AccessEntry{
+	Time: time.Date(2000, time.October, 10, 13, 55, 36, 0, time.FixedZone("", -7*60*60)),
+	RemoteAddr: "127.0.0.1:51234",
+	Method: "GET",
+	Target: "/apache_pb.gif",
+	Proto: "HTTP/1.0",
+	Status: response.StatusOk,
+	Bytes: 2326,
+	Duration: 1500 * time.Microsecond,
+	UserAgent: "Mozilla/4.08 [en] (Win98; I ;Nav)",
+	Referer: "http://www.example.com/start.html",
+	RequestID: "abc123",
+}
+
+func TestAccessLogFormats(t *testing.T) {
+	tests := []struct {
+		name string
+		format LogFormat
+		entry AccessEntry
+		want string
+	}{
+		{
+			name: "common",
+			format: LogCommon,
+			entry: testEntry,
+			want: `127.0.0.1 - - [10/Oct/2000:13:55:36 -0700] "GET /apache_pb.gif HTTP/1.0" 200 2326`,
+		},
+		{
+			name: "combined",
+			format: LogCombined,
+			entry: testEntry,
+			want: `127.0.0.1 - - [10/Oct/2000:13:55:36 -0700] "GET /apache_pb.gif HTTP/1.0" 200 2326 "http://www.example.com/start.html" "Mozilla/4.08 [en] (Win98; I ;Nav)"`,
+		},
+		{
+			name: "unreadable request",
+			format: LogCombined,
+			entry: AccessEntry{Time: testEntry.Time, RemoteAddr: "[::1]:80", Status: response.StatusBadRequest},
+			want: `::1 - - [10/Oct/2000:13:55:36 -0700] "-" 400 - "-" "-"`,
+		},
+		{
+			name: "escaped user agent",
+			format: LogCombined,
+			entry: AccessEntry{Time: testEntry.Time, Method: "GET", Target: "/", Proto: "HTTP/1.1", Status: 200, UserAgent: "evil\"\n127.0.0.1"},
+			want: `- - - [10/Oct/2000:13:55:36 -0700] "GET / HTTP/1.1" 200 - "-" "evil\"\x0a127.0.0.1"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := NewAccessLog(&buf, tt.format).Log(tt.entry); err != nil {
+				t.Fatalf("log: %v", err)
+			}
+			if got := buf.String(); got != tt.want + "\n" {
+				t.Fatalf("got  %q\nwant %q", got, tt.want + "\n")
+			}
+		})
+	}
+}
+
+func TestAccessLogJSON(t *testing.T) {
+	var buf bytes.Buffer
+	if err := NewAccessLog(&buf, LogJSON).Log(testEntry); err != nil {
+		t.Fatalf("log: %v", err)
+	}
+
+	var got map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("decoding %q: %v", buf.String(), err)
+	}
+
+	want := map[string]any{
+		"msg": "request",
+		"remote_addr": "127.0.0.1:51234",
+		"method": "GET",
+		"target": "/apache_pb.gif",
+		"proto": "HTTP/1.0",
+		"status": float64(200),
+		"bytes": float64(2326),
+		"duration": float64(1500 * time.Microsecond),
+		"user_agent": "Mozilla/4.08 [en] (Win98; I ;Nav)",
+		"referer": "http://www.example.com/start.html",
+		"request_id": "abc123",
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("%s: got %v, want %v", k, got[k], v)
+		}
+	}
+}
+
+func TestServerAccessLog(t *testing.T) {
+	var buf bytes.Buffer
+	srv := New(8080, okHandler)
+	srv.AccessLog = NewAccessLog(&buf, LogJSON)
+	client := serveConn(t, srv)
+	br := bufio.NewReader(client)
+
+	go io.WriteString(client, "GET /hello HTTP/1.1\r\nUser-Agent: test\r\nX-Request-ID: r1\r\n\r\n")
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("read response: %v", err)
+	}
+	readBody(t, resp)
+
+	go io.WriteString(client, "BROKEN\r\n\r\n")
+	if _, err := http.ReadResponse(br, nil); err != nil {
+		t.Fatalf("read response: %v", err)
+	}
+	// the entry for the bad request is written before the connection closes
+	io.Copy(io.Discard, br)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d entries, want 2:\n%s", len(lines), buf.String())
+	}
+
+	var first, second map[string]any
+	json.Unmarshal([]byte(lines[0]), &first)
+	json.Unmarshal([]byte(lines[1]), &second)
+
+	if first["target"] != "/hello" || first["status"] != float64(200) || first["bytes"] != float64(len("/hello")) {
+		t.Fatalf("first entry: %v", first)
+	}
+	if first["user_agent"] != "test" || first["request_id"] != "r1" || first["remote_addr"] == "" {
+		t.Fatalf("first entry: %v", first)
+	}
+	if second["method"] != "" || second["status"] != float64(400) {
+		t.Fatalf("second entry: %v", second)
+	}
+}
@@ -0,0 +1,174 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/reche13/http-from-scratch/internal/request"
+	"github.com/reche13/http-from-scratch/internal/response"
+)
+
+var ERROR_NO_CLIENT_CAS = fmt.Errorf("client certificate verification needs ClientCAs")
+
+// ClientAuth is how ServeTLS treats client certificates.
+type ClientAuth int
+
+const (
+	// NoClientCert does not ask clients for a certificate.
+	NoClientCert ClientAuth = iota
+	// RequestClientCert asks for a certificate but neither requires nor
+	// verifies it. It is only available in Request.TLS.
+	RequestClientCert
+	// VerifyClientCertIfGiven lets clients connect without a certificate,
+	// but verifies one against ClientCAs if it is sent.
+	VerifyClientCertIfGiven
+	// RequireClientCert refuses clients without a certificate verified
+	// against ClientCAs.
+	RequireClientCert
+)
+
+// applyClientAuth configures config to treat client certificates as mode
+// says, verifying them against cas, or else the ClientCAs config already
+// has.
+func applyClientAuth(config *tls.Config, mode ClientAuth, cas *x509.CertPool) error {
+	switch mode {
+	case NoClientCert:
+		return nil
+	case RequestClientCert:
+		config.ClientAuth = tls.RequestClientCert
+		return nil
+	case VerifyClientCertIfGiven:
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	case RequireClientCert:
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return fmt.Errorf("unknown client auth mode %d", mode)
+	}
+
+	if cas != nil {
+		config.ClientCAs = cas
+	}
+	// without a pool of its own, crypto/tls would trust the system roots,
+	// which vouch for anybody's certificate
+	if config.ClientCAs == nil {
+		return ERROR_NO_CLIENT_CAS
+	}
+	return nil
+}
+
+// AuthorizeClientCert only lets requests through whose client certificate
+// was verified and names one of allowed. Each entry says which name of the
+// certificate it matches:
+//
+//	subject:CN=alice,O=Example  the whole subject
+//	cn:alice                    the subject's common name
+//	dns:svc.example.com         a DNS name, ignoring case
+//	email:alice@example.com     an email address, ignoring the domain's case
+//	uri:spiffe://example/svc    a URI, exactly
+//	ip:10.0.0.1                 an IP address
+//
+// Other requests get 403 Forbidden. It panics on an entry of any other
+// form.
+func AuthorizeClientCert(allowed ...string) Middleware {
+	matchers := make([]certMatcher, len(allowed))
+	for i, a := range allowed {
+		m, err := parseCertMatcher(a)
+		if err != nil {
+			panic("AuthorizeClientCert: " + err.Error())
+		}
+		matchers[i] = m
+	}
+
+	return func(next Handler) Handler {
+		return func(w *response.Writer, r *request.Request) {
+			chain := r.PeerChain()
+			if len(chain) == 0 || !certNamesAny(chain[0], matchers) {
+				w.SetStatus(response.StatusForbidden)
+				return
+			}
+			next(w, r)
+		}
+	}
+}
+
+// certMatcher matches one kind of certificate name against value.
+type certMatcher struct {
+	kind string
+	value string
+}
+
+func parseCertMatcher(entry string) (certMatcher, error) {
+	kind, value, ok := strings.Cut(entry, ":")
+	if !ok || value == "" {
+		return certMatcher{}, fmt.Errorf("%q is not of the form kind:name", entry)
+	}
+
+	switch kind {
+	case "subject", "cn", "dns", "email", "uri":
+	case "ip":
+		if net.ParseIP(value) == nil {
+			return certMatcher{}, fmt.Errorf("%q is not an IP address", value)
+		}
+	default:
+		return certMatcher{}, fmt.Errorf("unknown name kind %q in %q", kind, entry)
+	}
+	return certMatcher{kind: kind, value: value}, nil
+}
+
+// certNamesAny reports whether cert has a name matched by any of matchers.
+func certNamesAny(cert *x509.Certificate, matchers []certMatcher) bool {
+	for _, m := range matchers {
+		if m.matches(cert) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m certMatcher) matches(cert *x509.Certificate) bool {
+	switch m.kind {
+	case "subject":
+		return cert.Subject.String() == m.value
+	case "cn":
+		return cert.Subject.CommonName == m.value
+	case "dns":
+		for _, name := range cert.DNSNames {
+			if strings.EqualFold(name, m.value) {
+				return true
+			}
+		}
+	case "email":
+		for _, addr := range cert.EmailAddresses {
+			if sameEmail(addr, m.value) {
+				return true
+			}
+		}
+	case "uri":
+		for _, u := range cert.URIs {
+			if u.String() == m.value {
+				return true
+			}
+		}
+	case "ip":
+		ip := net.ParseIP(m.value)
+		for _, addr := range cert.IPAddresses {
+			if addr.Equal(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// sameEmail compares two addresses, the local parts exactly and the
+// domains ignoring case.
+func sameEmail(a, b string) bool {
+	i, j := strings.LastIndexByte(a, '@'), strings.LastIndexByte(b, '@')
+	if i == -1 || j == -1 {
+		return a == b
+	}
+	return a[:i] == b[:j] && strings.EqualFold(a[i:], b[j:])
+}
@@ -0,0 +1,248 @@
+package server
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/reche13/http-from-scratch/internal/request"
+	"github.com/reche13/http-from-scratch/internal/response"
+)
+
+type testCA struct {
+	*testCert
+	pool *x509.CertPool
+}
+
+func newCA(t *testing.T, name string) *testCA {
+	t.Helper()
+	c := newCert(t, &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject: pkix.Name{CommonName: name},
+		KeyUsage: x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA: true,
+	}, nil)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(c.cert)
+	return &testCA{testCert: c, pool: pool}
+}
+
+// issue returns a client certificate for subject signed by ca.
+func (ca *testCA) issue(t *testing.T, subject pkix.Name, dnsNames, emails []string, uris ...string) tls.Certificate {
+	t.Helper()
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject: subject,
+		DNSNames: dnsNames,
+		EmailAddresses: emails,
+		KeyUsage: x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	for _, u := range uris {
+		parsed, _ := url.Parse(u)
+		tmpl.URIs = append(tmpl.URIs, parsed)
+	}
+	return newCert(t, tmpl, ca.testCert).tlsCertificate()
+}
+
+// subjectHandler answers with the verified peer subject and chain length,
+// or with how many unverified certificates the client sent.
+func subjectHandler(w *response.Writer, r *request.Request) {
+	if chain := r.PeerChain(); chain != nil {
+		w.Write([]byte(r.PeerSubject()))
+		w.Write([]byte{byte('0' + len(chain))})
+		return
+	}
+	w.Write([]byte{byte('0' + len(r.TLS.PeerCertificates))})
+}
+
+// requestWithCert sends a request over TLS, presenting certs to the
+// server, and returns the response body or the error that stopped it.
+func requestWithCert(t *testing.T, addr string, certs ...tls.Certificate) (int, string, error) {
+	t.Helper()
+	config := &tls.Config{
+		InsecureSkipVerify: true,
+		// present the certificate even if the server does not list its
+		// issuer among the ones it accepts
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			if len(certs) == 0 {
+				return &tls.Certificate{}, nil
+			}
+			return &certs[0], nil
+		},
+	}
+	conn, err := tls.Dial("tcp", addr, config)
+	if err != nil {
+		return 0, "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// with TLS 1.3 a rejected certificate only shows on the first read
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: x\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		return 0, "", err
+	}
+	return resp.StatusCode, readBody(t, resp), nil
+}
+
+func serveMTLS(t *testing.T, mode ClientAuth, ca *testCA, handler Handler) string {
+	t.Helper()
+	certFile, keyFile := writeCert(t, t.TempDir(), "server", 1, "example.test")
+	srv := New(0, handler)
+	srv.ClientAuth = mode
+	srv.ClientCAs = ca.pool
+	return serveTLS(t, srv, certFile, keyFile)
+}
+
+func TestClientAuthModes(t *testing.T) {
+	ca := newCA(t, "Test CA")
+	alice := ca.issue(t, pkix.Name{CommonName: "alice", Organization: []string{"Example"}}, nil, nil)
+	stranger := newCA(t, "Other CA").issue(t, pkix.Name{CommonName: "mallory"}, nil, nil)
+
+	tests := []struct {
+		name string
+		mode ClientAuth
+		certs []tls.Certificate
+		ok bool
+		body string
+	}{
+		{"none ignores certificates", NoClientCert, []tls.Certificate{alice}, true, "0"},
+		{"request without certificate", RequestClientCert, nil, true, "0"},
+		{"request takes any certificate", RequestClientCert, []tls.Certificate{stranger}, true, "1"},
+		{"verify-if-given without certificate", VerifyClientCertIfGiven, nil, true, "0"},
+		{"verify-if-given verifies", VerifyClientCertIfGiven, []tls.Certificate{alice}, true, "CN=alice,O=Example2"},
+		{"verify-if-given rejects unknown issuer", VerifyClientCertIfGiven, []tls.Certificate{stranger}, false, ""},
+		{"require without certificate", RequireClientCert, nil, false, ""},
+		{"require verifies", RequireClientCert, []tls.Certificate{alice}, true, "CN=alice,O=Example2"},
+		{"require rejects unknown issuer", RequireClientCert, []tls.Certificate{stranger}, false, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr := serveMTLS(t, tt.mode, ca, subjectHandler)
+
+			_, body, err := requestWithCert(t, addr, tt.certs...)
+			if !tt.ok {
+				if err == nil {
+					t.Fatalf("request succeeded with body %q", body)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("request: %v", err)
+			}
+			if body != tt.body {
+				t.Fatalf("body: got %q, want %q", body, tt.body)
+			}
+		})
+	}
+}
+
+func TestClientAuthNeedsCAs(t *testing.T) {
+	certFile, keyFile := writeCert(t, t.TempDir(), "server", 1, "example.test")
+	for _, mode := range []ClientAuth{VerifyClientCertIfGiven, RequireClientCert} {
+		srv := New(0, okHandler)
+		srv.ClientAuth = mode
+		if _, err := srv.tlsConfig(certFile, keyFile); err != ERROR_NO_CLIENT_CAS {
+			t.Fatalf("mode %d: got %v, want %v", mode, err, ERROR_NO_CLIENT_CAS)
+		}
+	}
+
+	// a pool from TLSConfig does as well
+	ca := newCA(t, "Test CA")
+	srv := New(0, okHandler)
+	srv.ClientAuth = RequireClientCert
+	srv.TLSConfig = &tls.Config{ClientCAs: ca.pool}
+	config, err := srv.tlsConfig(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("tls config: %v", err)
+	}
+	if config.ClientCAs != ca.pool || config.ClientAuth != tls.RequireAndVerifyClientCert {
+		t.Fatalf("client auth not configured from TLSConfig")
+	}
+}
+
+func TestAuthorizeClientCert(t *testing.T) {
+	ca := newCA(t, "Test CA")
+	authorize := AuthorizeClientCert(
+		"cn:alice",
+		"subject:CN=bob,O=Example",
+		"dns:svc.internal.test",
+		"email:carol@example.test",
+		"uri:spiffe://example.test/worker",
+		"ip:10.0.0.1",
+	)
+	addr := serveMTLS(t, VerifyClientCertIfGiven, ca, authorize(okHandler))
+
+	withIP := func(cn, ip string) tls.Certificate {
+		t.Helper()
+		c := newCert(t, &x509.Certificate{
+			SerialNumber: big.NewInt(3),
+			Subject: pkix.Name{CommonName: cn},
+			IPAddresses: []net.IP{net.ParseIP(ip)},
+			KeyUsage: x509.KeyUsageDigitalSignature,
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}, ca.testCert)
+		return c.tlsCertificate()
+	}
+
+	tests := []struct {
+		name string
+		certs []tls.Certificate
+		status int
+	}{
+		{"common name", []tls.Certificate{ca.issue(t, pkix.Name{CommonName: "alice"}, nil, nil)}, 200},
+		{"common name in other case", []tls.Certificate{ca.issue(t, pkix.Name{CommonName: "Alice"}, nil, nil)}, 403},
+		{"common name as DNS name", []tls.Certificate{ca.issue(t, pkix.Name{CommonName: "x"}, []string{"alice"}, nil)}, 403},
+		{"full subject", []tls.Certificate{ca.issue(t, pkix.Name{CommonName: "bob", Organization: []string{"Example"}}, nil, nil)}, 200},
+		{"subject with other organization", []tls.Certificate{ca.issue(t, pkix.Name{CommonName: "bob", Organization: []string{"Other"}}, nil, nil)}, 403},
+		{"DNS name", []tls.Certificate{ca.issue(t, pkix.Name{CommonName: "svc"}, []string{"svc.internal.test"}, nil)}, 200},
+		{"DNS name in other case", []tls.Certificate{ca.issue(t, pkix.Name{CommonName: "svc"}, []string{"SVC.Internal.Test"}, nil)}, 200},
+		{"DNS name as common name", []tls.Certificate{ca.issue(t, pkix.Name{CommonName: "svc.internal.test"}, nil, nil)}, 403},
+		{"email", []tls.Certificate{ca.issue(t, pkix.Name{CommonName: "carol"}, nil, []string{"carol@EXAMPLE.test"})}, 200},
+		{"email with other local part case", []tls.Certificate{ca.issue(t, pkix.Name{CommonName: "carol"}, nil, []string{"Carol@example.test"})}, 403},
+		{"URI", []tls.Certificate{ca.issue(t, pkix.Name{CommonName: "w"}, nil, nil, "spiffe://example.test/worker")}, 200},
+		{"URI with other path case", []tls.Certificate{ca.issue(t, pkix.Name{CommonName: "w"}, nil, nil, "spiffe://example.test/Worker")}, 403},
+		{"IP address", []tls.Certificate{withIP("ip", "10.0.0.1")}, 200},
+		{"other IP address", []tls.Certificate{withIP("ip", "10.0.0.2")}, 403},
+		{"unknown client", []tls.Certificate{ca.issue(t, pkix.Name{CommonName: "dave"}, nil, nil)}, 403},
+		{"no certificate", nil, 403},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, _, err := requestWithCert(t, addr, tt.certs...)
+			if err != nil {
+				t.Fatalf("request: %v", err)
+			}
+			if status != tt.status {
+				t.Fatalf("status: got %d, want %d", status, tt.status)
+			}
+		})
+	}
+}
+
+func TestAuthorizeClientCertRejectsUntypedNames(t *testing.T) {
+	for _, entry := range []string{"alice", "host:alice", "cn:", "ip:not-an-ip"} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Fatalf("%q: expected a panic", entry)
+				}
+			}()
+			AuthorizeClientCert(entry)
+		}()
+	}
+}
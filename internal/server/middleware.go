@@ -0,0 +1,17 @@
+package server
+
+// Middleware wraps a Handler with behavior that runs around it, such as
+// logging or authentication. The returned Handler decides whether and when
+// to call the one it wraps.
+type Middleware func(Handler) Handler
+
+// Chain combines middlewares into one. The first middleware is the
+// outermost: Chain(a, b)(h) runs a, then b, then h.
+func Chain(middlewares ...Middleware) Middleware {
+	return func(h Handler) Handler {
+		for i := len(middlewares) - 1; i >= 0; i-- {
+			h = middlewares[i](h)
+		}
+		return h
+	}
+}
@@ -0,0 +1,68 @@
+package server
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/reche13/http-from-scratch/internal/request"
+	"github.com/reche13/http-from-scratch/internal/response"
+)
+
+func TestChain(t *testing.T) {
+	var calls []string
+	trace := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return func(w *response.Writer, r *request.Request) {
+				calls = append(calls, name+" before")
+				next(w, r)
+				calls = append(calls, name+" after")
+			}
+		}
+	}
+
+	h := Chain(trace("a"), trace("b"))(func(w *response.Writer, r *request.Request) {
+		calls = append(calls, "handler")
+	})
+	h(response.NewWriter(&bytes.Buffer{}), nil)
+
+	want := "a before,b before,handler,b after,a after"
+	if got := strings.Join(calls, ","); got != want {
+		t.Fatalf("calls: got %q, want %q", got, want)
+	}
+}
+
+func TestChainEmpty(t *testing.T) {
+	called := false
+	h := Chain()(func(w *response.Writer, r *request.Request) { called = true })
+	h(response.NewWriter(&bytes.Buffer{}), nil)
+
+	if !called {
+		t.Fatalf("handler was not called")
+	}
+}
+
+func TestMiddlewareObservesResponse(t *testing.T) {
+	var status response.StatusCode
+	var written int64
+	observe := func(next Handler) Handler {
+		return func(w *response.Writer, r *request.Request) {
+			next(w, r)
+			status = w.Status()
+			written = w.BytesWritten()
+		}
+	}
+
+	h := Chain(observe)(func(w *response.Writer, r *request.Request) {
+		w.SetStatus(response.StatusAccepted)
+		w.Write([]byte("short and stout"))
+	})
+	h(response.NewWriter(&bytes.Buffer{}), nil)
+
+	if status != response.StatusAccepted {
+		t.Fatalf("status: got %d, want %d", status, response.StatusAccepted)
+	}
+	if written != int64(len("short and stout")) {
+		t.Fatalf("bytes: got %d, want %d", written, len("short and stout"))
+	}
+}
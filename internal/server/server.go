@@ -1,29 +1,106 @@
 package server
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"os"
-	"os/signal"
-	"syscall"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/reche13/http-from-scratch/internal/request"
 	"github.com/reche13/http-from-scratch/internal/response"
 )
 
+const (
+	DefaultIdleTimeout = 60 * time.Second
+	DefaultMaxRequestsPerConn = 100
+)
+
 type Server struct {
 	Addr string
+	// ReadHeaderTimeout bounds the time from the first byte of a request
+	// until its header section has been read. Clients that miss it get a
+	// 408. Zero falls back to ReadTimeout, then to IdleTimeout.
+	ReadHeaderTimeout time.Duration
+	// ReadTimeout bounds the time from the first byte of a request until
+	// its body has been read. Zero means no timeout.
+	ReadTimeout time.Duration
+	// WriteTimeout bounds the time spent writing a response, measured from
+	// the end of the request's header section. Zero means no timeout.
+	WriteTimeout time.Duration
+	// HandlerTimeout bounds the time a handler has to serve a request: its
+	// context is canceled once it runs out. Zero means no timeout.
+	HandlerTimeout time.Duration
+	// IdleTimeout is how long a connection may wait for the next request
+	// before it is closed. Zero falls back to ReadTimeout.
+	IdleTimeout time.Duration
+	// MaxRequestsPerConn caps the number of requests served on a single
+	// connection. Zero means no limit.
+	MaxRequestsPerConn int
+	// Limits bounds the size of incoming requests.
+	Limits request.Limits
+	// PathPolicy decides what happens to requests whose path is not in
+	// canonical form. The default redirects to the canonical path.
+	PathPolicy request.PathPolicy
+	// AllowEncodedSlash lets %2F through in request paths instead of
+	// answering 400.
+	AllowEncodedSlash bool
+	// PanicHandler, if set, is called with the recovered value and stack
+	// trace when a handler panics, for example to report it to an error
+	// tracker. The panic is logged either way.
+	PanicHandler func(r *request.Request, recovered any, stack []byte)
+	// AccessLog, if set, records every request served.
+	AccessLog *AccessLog
+	// TLSConfig, if set, is the base configuration ServeTLS uses.
+	TLSConfig *tls.Config
+	// Certs serves the certificates for ServeTLS and reloads them when
+	// they change on disk. ServeTLS creates it if it is nil.
+	Certs *CertLoader
+	// CertCheckInterval is how often ServeTLS checks the files of Certs
+	// for changes. Zero means DefaultCertCheckInterval.
+	CertCheckInterval time.Duration
+	// ClientAuth decides whether ServeTLS asks clients for certificates
+	// and verifies them against ClientCAs, or TLSConfig.ClientCAs if that
+	// is nil.
+	ClientAuth ClientAuth
+	ClientCAs *x509.CertPool
 	ln net.Listener
 	handler Handler
 	done chan struct{}
+	// ctx is the parent of every request's context and is canceled when
+	// the server is closed or a graceful shutdown runs out of time
+	ctx context.Context
+	cancel context.CancelFunc
+	closeOnce sync.Once
+	// shutdowns counts the Shutdown calls in progress, which Serve waits
+	// for before it returns
+	shutdowns sync.WaitGroup
+	// lastConnID numbers accepted connections
+	lastConnID atomic.Uint64
+	mu sync.Mutex
+	conns map[net.Conn]connState
 }
 
 func New(port uint16, handler Handler ) *Server {
+	ctx, cancel := context.WithCancel(context.Background())
 	return &Server{
 		Addr: fmt.Sprintf(":%d", port),
+		IdleTimeout: DefaultIdleTimeout,
+		MaxRequestsPerConn: DefaultMaxRequestsPerConn,
+		Limits: request.DefaultLimits,
 		handler: handler,
 		done: make(chan struct{}),
+		ctx: ctx,
+		cancel: cancel,
+		conns: make(map[net.Conn]connState),
 	}
 }
 
@@ -34,23 +111,64 @@ type HandlerError struct {
 
 type Handler func(w *response.Writer, r *request.Request)
 
-
+// Serve accepts connections on Addr until the server is closed or shut
+// down. While Shutdown is draining connections, Serve only returns once it
+// has finished, so that a program exiting when Serve returns does not cut
+// off the requests still being served.
 func (s *Server) Serve() error {
-	var err error
-	s.ln, err = net.Listen("tcp", s.Addr)
+	ln, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return  err
+	}
+	return s.serveListener(ln)
+}
+
+// ServeTLS is like Serve but speaks TLS. certFile and keyFile name a
+// certificate and key in PEM format; they may be empty when Certs or
+// TLSConfig already provide the certificates. Certificates in Certs are
+// reloaded when their files change or the process receives SIGHUP.
+func (s *Server) ServeTLS(certFile, keyFile string) error {
+	config, err := s.tlsConfig(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+
+	ln, err := net.Listen("tcp", s.Addr)
 	if err != nil {
 		return  err
 	}
 
+	interval := s.CertCheckInterval
+	if interval <= 0 {
+		interval = DefaultCertCheckInterval
+	}
+	go s.Certs.Watch(interval, s.done)
+	return s.serveListener(tls.NewListener(ln, config))
+}
+
+// serveListener accepts connections on ln until the server shuts down.
+func (s *Server) serveListener(ln net.Listener) error {
+	s.mu.Lock()
+	s.ln = ln
+	s.mu.Unlock()
+
+	// Close or Shutdown may have run before the listener existed
+	if s.shuttingDown() {
+		ln.Close()
+		s.shutdowns.Wait()
+		return nil
+	}
+
 	log.Printf("listening on %s", s.Addr)
 
 	go s.handleShutdownSignals()
 
 	for {
-		conn, err := s.ln.Accept()
+		conn, err := ln.Accept()
 		if err != nil {
 			select {
 			case <-s.done:
+				s.shutdowns.Wait()
 				return nil
 			default:
 				log.Printf("connection accept error: %v", err)
@@ -58,36 +176,330 @@ func (s *Server) Serve() error {
 			}
 		}
 
+		if !s.trackConn(conn) {
+			conn.Close()
+			continue
+		}
 		go s.handleConn(conn)
 	}
 }
 
+// handleConn serves the requests on conn, which must have been registered
+// with trackConn.
 func (s *Server) handleConn(conn net.Conn) {
-	defer conn.Close()
+	connID := s.lastConnID.Add(1)
+	connCtx, cancelConn := context.WithCancel(s.ctx)
+	defer func() {
+		cancelConn()
+		conn.Close()
+		s.forgetConn(conn)
+	}()
 
-	responseWriter := response.NewWriter(conn)
-	r, err := request.ReadRequest(conn)
-	if err != nil {
-		responseWriter.WriteStatusLine(response.StatusBadRequest)
-		responseWriter.WriteHeaders(response.GetDefaultHeaders(0))
-		return
+	var tlsState *tls.ConnectionState
+	if tc, ok := conn.(*tls.Conn); ok {
+		conn.SetDeadline(deadline(time.Now(), s.readHeaderTimeout()))
+		if err := tc.HandshakeContext(connCtx); err != nil {
+			log.Printf("TLS handshake error from %s: %v", conn.RemoteAddr(), err)
+			return
+		}
+		state := tc.ConnectionState()
+		tlsState = &state
+	}
+
+	// requests are handled one at a time, so responses to pipelined
+	// requests go out in the order the requests arrived
+	reader := request.NewReaderWithLimits(conn, s.Limits)
+	reader.AllowEncodedSlash = s.AllowEncodedSlash
+	for served := 0; ; served++ {
+		conn.SetReadDeadline(deadline(time.Now(), s.idleTimeout()))
+
+		// a client going away or idling out between requests is not an error
+		if err := reader.Ready(); err != nil {
+			return
+		}
+		s.setConnState(conn, stateActive)
+
+		start := time.Now()
+		conn.SetReadDeadline(deadline(start, s.readHeaderTimeout()))
+
+		responseWriter := response.NewWriter(conn)
+		r, err := reader.ReadRequest()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return
+			}
+			conn.SetWriteDeadline(deadline(time.Now(), s.WriteTimeout))
+			responseWriter.SetKeepAlive(false)
+			responseWriter.WriteStatusLine(statusForError(err))
+			responseWriter.WriteHeaders(response.GetDefaultHeaders(0))
+			s.logAccess(conn, nil, responseWriter, start)
+			return
+		}
+		conn.SetReadDeadline(deadline(start, s.ReadTimeout))
+		conn.SetWriteDeadline(deadline(time.Now(), s.WriteTimeout))
+
+		r.RemoteAddr = conn.RemoteAddr().String()
+		r.LocalAddr = conn.LocalAddr().String()
+		r.ConnID = connID
+		r.Seq = served + 1
+		r.TLS = tlsState
+
+		responseWriter.SetHTTPVersion(r.RequestLine.ProtoMajor, r.RequestLine.ProtoMinor)
+		lastAllowed := s.MaxRequestsPerConn > 0 && served+1 >= s.MaxRequestsPerConn
+		responseWriter.SetKeepAlive(r.KeepAlive() && !lastAllowed && !s.shuttingDown())
+
+		ctx, cancel := s.requestContext(connCtx)
+		r.SetContext(ctx)
+		// while the handler runs nothing else reads from the connection
+		// once the body, if any, is read, so a closed connection can be
+		// noticed
+		watcher := &connWatcher{conn: conn, reader: reader, cancel: cancelConn}
+		reader.OnBodyEOF = watcher.start
+		if r.Body == request.NoBody {
+			watcher.start()
+		}
+
+		ok := s.checkPath(responseWriter, r) || s.serve(responseWriter, r)
+		cancel()
+		watcher.stop()
+
+		if !ok {
+			// whatever the handler left behind cannot be trusted
+			if err := responseWriter.Reset(); err != nil {
+				abort(conn)
+				s.logAccess(conn, r, responseWriter, start)
+				return
+			}
+			responseWriter.SetKeepAlive(false)
+			responseWriter.SetStatus(response.StatusInternalServerError)
+			responseWriter.Finish()
+			s.logAccess(conn, r, responseWriter, start)
+			return
+		}
+		r.Body.Close()
+
+		// whatever the handler left unread must be skipped before the next
+		// request can be parsed. It is done before the response is
+		// finished, so that the response can still announce the connection
+		// closing when too much is left.
+		if responseWriter.KeepAlive() {
+			// the ReadTimeout deadline, if any, still holds; otherwise the
+			// rest of the body is bounded like a header section
+			if s.ReadTimeout <= 0 {
+				conn.SetReadDeadline(deadline(time.Now(), s.readHeaderTimeout()))
+			}
+			if err := reader.Discard(); err != nil {
+				responseWriter.SetKeepAlive(false)
+			}
+		}
+
+		err = responseWriter.Finish()
+		if err != nil && responseWriter.Reset() == nil {
+			// the response was refused before any of it was written, for
+			// instance over an invalid field in Header
+			log.Printf("response to %s %s: %v", r.RequestLine.Method, r.RequestLine.Path, err)
+			responseWriter.SetKeepAlive(false)
+			responseWriter.SetStatus(response.StatusInternalServerError)
+			responseWriter.Finish()
+		}
+		s.logAccess(conn, r, responseWriter, start)
+		if err != nil || !responseWriter.KeepAlive() {
+			return
+		}
+
+		s.setConnState(conn, stateIdle)
+		if s.shuttingDown() {
+			return
+		}
+	}
+}
+
+// requestContext returns the context for a request on a connection whose
+// context is parent, bounded by HandlerTimeout.
+func (s *Server) requestContext(parent context.Context) (context.Context, context.CancelFunc) {
+	if s.HandlerTimeout > 0 {
+		return context.WithTimeout(parent, s.HandlerTimeout)
+	}
+	return context.WithCancel(parent)
+}
+
+// connWatcher runs watchConn for the duration of a handler, starting
+// whenever the request body has been read.
+type connWatcher struct {
+	conn net.Conn
+	reader *request.Reader
+	cancel context.CancelFunc
+	mu sync.Mutex
+	stopWatching func()
+	stopped bool
+}
+
+func (w *connWatcher) start() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.stopped && w.stopWatching == nil {
+		w.stopWatching = watchConn(w.conn, w.reader, w.cancel)
 	}
+}
 
-	s.handler(responseWriter, r)
+// stop stops the watch, if it started, and keeps it from starting later.
+func (w *connWatcher) stop() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.stopped = true
+	if w.stopWatching != nil {
+		w.stopWatching()
+	}
 }
 
-func (s *Server) Close() {
-	close(s.done)
-	if s.ln != nil {
-		s.ln.Close()
+// watchConn reads ahead on conn in the background and calls cancel if the
+// client closes the connection. The returned function stops the read; it
+// must be called before reader is used again, and leaves the read deadline
+// in the past.
+func watchConn(conn net.Conn, reader *request.Reader, cancel context.CancelFunc) func() {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// a read timing out means the client is slow, not gone; a byte
+		// arriving means it is still there, and there is no need to read
+		// further ahead
+		if err := reader.ReadAhead(); err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+			cancel()
+		}
+	}()
+
+	return func() {
+		conn.SetReadDeadline(time.Unix(1, 0))
+		<-done
 	}
 }
 
-func (s *Server) handleShutdownSignals() {
-	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
-	<-sigCh
+// serve runs the handler for r and reports whether it returned normally.
+// A panic is recovered so that it only takes down this request.
+func (s *Server) serve(w *response.Writer, r *request.Request) (ok bool) {
+	defer func() {
+		p := recover()
+		if p == nil {
+			return
+		}
+		stack := debug.Stack()
+		log.Printf("panic serving %s %s: %v\n%s", r.RequestLine.Method, r.RequestLine.Path, p, stack)
+		if s.PanicHandler != nil {
+			s.reportPanic(r, p, stack)
+		}
+	}()
+
+	s.handler(w, r)
+	return true
+}
+
+// reportPanic passes a panic recovered from the handler to PanicHandler. A
+// panic in PanicHandler itself is logged, not left to crash the process.
+func (s *Server) reportPanic(r *request.Request, recovered any, stack []byte) {
+	defer func() {
+		if p := recover(); p != nil {
+			log.Printf("panic in PanicHandler: %v\n%s", p, debug.Stack())
+		}
+	}()
+
+	s.PanicHandler(r, recovered, stack)
+}
+
+// abort closes conn in the middle of a response. A TCP connection is reset
+// rather than closed cleanly, so that a client reading a close-delimited
+// body cannot mistake the partial response for a complete one.
+func abort(conn net.Conn) {
+	if tc, ok := conn.(*tls.Conn); ok {
+		// closing the TLS layer would send close_notify, announcing a
+		// clean end of the stream
+		conn = tc.NetConn()
+	}
+	if tc, ok := conn.(*net.TCPConn); ok {
+		tc.SetLinger(0)
+	}
+	conn.Close()
+}
 
-	log.Printf("shutting down...")
-	s.Close()
-}
\ No newline at end of file
+// checkPath applies the PathPolicy to r. It reports whether a response has
+// already been written in place of running the handler.
+func (s *Server) checkPath(w *response.Writer, r *request.Request) bool {
+	if s.PathPolicy == request.PathPassThrough || r.Target.Form == request.AsteriskForm || r.Target.Form == request.AuthorityForm {
+		return false
+	}
+
+	clean := request.CleanPath(r.Target.Path)
+	if clean == r.Target.Path {
+		return false
+	}
+
+	if s.PathPolicy == request.PathReject {
+		w.SetStatus(response.StatusBadRequest)
+		return true
+	}
+
+	// 308 keeps the method and body of anything but a plain fetch
+	status := response.StatusPermanentRedirect
+	if r.RequestLine.Method == "GET" || r.RequestLine.Method == "HEAD" {
+		status = response.StatusMovedPermanently
+	}
+	location := request.EscapePath(clean)
+	if r.Target.RawQuery != "" {
+		location += "?" + r.Target.RawQuery
+	}
+	w.SetStatus(status)
+	w.Header().Replace("Location", location)
+	return true
+}
+
+// readHeaderTimeout bounds the header section of a request, and the TLS
+// handshake before the first one. Without ReadHeaderTimeout or ReadTimeout
+// it falls back to the idle timeout, so that a client that stops sending
+// in the middle of a request is never waited on forever.
+func (s *Server) readHeaderTimeout() time.Duration {
+	if s.ReadHeaderTimeout > 0 {
+		return s.ReadHeaderTimeout
+	}
+	if s.ReadTimeout > 0 {
+		return s.ReadTimeout
+	}
+	return s.idleTimeout()
+}
+
+func (s *Server) idleTimeout() time.Duration {
+	if s.IdleTimeout > 0 {
+		return s.IdleTimeout
+	}
+	return s.ReadTimeout
+}
+
+// deadline returns the time d after start, or the zero time, which clears a
+// connection deadline, when d is not positive.
+func deadline(start time.Time, d time.Duration) time.Time {
+	if d <= 0 {
+		return time.Time{}
+	}
+	return start.Add(d)
+}
+
+// statusForError picks the status code reported to a client whose request
+// could not be read.
+func statusForError(err error) response.StatusCode {
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return response.StatusRequestTimeout
+	}
+
+	switch err {
+	case request.ERROR_REQUEST_LINE_TOO_LONG:
+		return response.StatusURITooLong
+	case request.ERROR_HEADERS_TOO_LARGE:
+		return response.StatusRequestHeaderFieldsTooLarge
+	case request.ERROR_BODY_TOO_LARGE:
+		return response.StatusContentTooLarge
+	case request.ERROR_UNSUPPORTED_TRANSFER_CODING:
+		return response.StatusNotImplemented
+	case request.ERROR_UNSUPPORTED_VERSION:
+		return response.StatusHTTPVersionNotSupported
+	default:
+		return response.StatusBadRequest
+	}
+}
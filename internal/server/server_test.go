@@ -1,7 +1,17 @@
 package server
 
 import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/reche13/http-from-scratch/internal/request"
 	"github.com/reche13/http-from-scratch/internal/response"
@@ -36,3 +46,1144 @@ func TestClose(t *testing.T) {
 		t.Fatalf("done channel should be closed")
 	}
 }
+
+func okHandler(w *response.Writer, r *request.Request) {
+	body := []byte(r.RequestLine.Path)
+	w.WriteStatusLine(response.StatusOk)
+	w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+	w.WriteBody(body)
+}
+
+// serveConn runs handleConn on one end of an in-memory connection and
+// returns the client end.
+func serveConn(t *testing.T, srv *Server) net.Conn {
+	t.Helper()
+	client, conn := net.Pipe()
+	srv.trackConn(conn)
+	go srv.handleConn(conn)
+	t.Cleanup(func() { client.Close() })
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	return client
+}
+
+func readBody(t *testing.T, resp *http.Response) string {
+	t.Helper()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("reading body: %v", err)
+	}
+	return string(b)
+}
+
+func TestKeepAlive(t *testing.T) {
+	srv := New(8080, okHandler)
+	client := serveConn(t, srv)
+	br := bufio.NewReader(client)
+
+	for _, path := range []string{"/one", "/two"} {
+		if _, err := io.WriteString(client, "GET "+path+" HTTP/1.1\r\nHost: x\r\n\r\n"); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatalf("read response: %v", err)
+		}
+		if resp.Close {
+			t.Fatalf("%s: connection should be kept alive", path)
+		}
+		if got := readBody(t, resp); got != path {
+			t.Fatalf("body: got %q, want %q", got, path)
+		}
+	}
+}
+
+func TestConnectionClose(t *testing.T) {
+	srv := New(8080, okHandler)
+	client := serveConn(t, srv)
+	br := bufio.NewReader(client)
+
+	io.WriteString(client, "GET / HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("read response: %v", err)
+	}
+	if !resp.Close {
+		t.Fatalf("response should announce Connection: close")
+	}
+	readBody(t, resp)
+
+	if _, err := br.ReadByte(); err != io.EOF {
+		t.Fatalf("expected connection to be closed, got %v", err)
+	}
+}
+
+func TestMaxRequestsPerConn(t *testing.T) {
+	srv := New(8080, okHandler)
+	srv.MaxRequestsPerConn = 2
+	client := serveConn(t, srv)
+	br := bufio.NewReader(client)
+
+	for i, wantClose := range []bool{false, true} {
+		io.WriteString(client, "GET / HTTP/1.1\r\nHost: x\r\n\r\n")
+
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatalf("request %d: read response: %v", i, err)
+		}
+		if resp.Close != wantClose {
+			t.Fatalf("request %d: close got %v, want %v", i, resp.Close, wantClose)
+		}
+		readBody(t, resp)
+	}
+
+	if _, err := br.ReadByte(); err != io.EOF {
+		t.Fatalf("expected connection to be closed, got %v", err)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	srv := New(8080, okHandler)
+	srv.IdleTimeout = 50 * time.Millisecond
+	client := serveConn(t, srv)
+
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected idle connection to be closed, got %v", err)
+	}
+}
+
+func TestPipelining(t *testing.T) {
+	srv := New(8080, okHandler)
+	client := serveConn(t, srv)
+	br := bufio.NewReader(client)
+
+	paths := []string{"/a", "/b", "/c"}
+	go func() {
+		raw := ""
+		for _, path := range paths {
+			raw += "GET " + path + " HTTP/1.1\r\nHost: x\r\n\r\n"
+		}
+		io.WriteString(client, raw)
+	}()
+
+	for _, path := range paths {
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatalf("%s: read response: %v", path, err)
+		}
+		if got := readBody(t, resp); got != path {
+			t.Fatalf("responses out of order: got %q, want %q", got, path)
+		}
+	}
+}
+
+func TestUnreadBodyIsSkipped(t *testing.T) {
+	srv := New(8080, okHandler)
+	client := serveConn(t, srv)
+	br := bufio.NewReader(client)
+
+	go io.WriteString(client, ""+
+		"POST /upload HTTP/1.1\r\nHost: x\r\nContent-Length: 5\r\n\r\nHello"+
+		"GET /next HTTP/1.1\r\nHost: x\r\n\r\n")
+
+	for _, path := range []string{"/upload", "/next"} {
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatalf("%s: read response: %v", path, err)
+		}
+		if got := readBody(t, resp); got != path {
+			t.Fatalf("body: got %q, want %q", got, path)
+		}
+	}
+}
+
+func TestLimitStatus(t *testing.T) {
+	tests := []struct {
+		name       string
+		input      string
+		wantStatus int
+	}{
+		{
+			name:       "request-line too long",
+			input:      "GET /" + strings.Repeat("a", 100) + " HTTP/1.1\r\n\r\n",
+			wantStatus: 414,
+		},
+		{
+			name:       "header section too large",
+			input:      "GET / HTTP/1.1\r\nX-Big: " + strings.Repeat("x", 100) + "\r\n\r\n",
+			wantStatus: 431,
+		},
+		{
+			name:       "body too large",
+			input:      "POST / HTTP/1.1\r\nContent-Length: 100\r\n\r\n",
+			wantStatus: 413,
+		},
+		{
+			name:       "malformed request",
+			input:      "GET /\r\n\r\n",
+			wantStatus: 400,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := New(8080, okHandler)
+			srv.Limits = request.Limits{
+				MaxRequestLineBytes: 64,
+				MaxHeaderBytes:      64,
+				MaxBodyBytes:        10,
+			}
+			client := serveConn(t, srv)
+
+			go io.WriteString(client, tt.input)
+
+			resp, err := http.ReadResponse(bufio.NewReader(client), nil)
+			if err != nil {
+				t.Fatalf("read response: %v", err)
+			}
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("status: got %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+			if !resp.Close {
+				t.Fatalf("connection should be closed after a rejected request")
+			}
+		})
+	}
+}
+
+func TestReadHeaderTimeout(t *testing.T) {
+	tests := []struct {
+		name string
+		configure func(srv *Server)
+	}{
+		{"header timeout", func(srv *Server) { srv.ReadHeaderTimeout = 50 * time.Millisecond }},
+		{"falls back to idle timeout", func(srv *Server) { srv.IdleTimeout = 50 * time.Millisecond }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := New(8080, okHandler)
+			tt.configure(srv)
+			client := serveConn(t, srv)
+
+			// the header section never completes
+			io.WriteString(client, "GET / HTTP/1.1\r\nHost: x\r\n")
+
+			resp, err := http.ReadResponse(bufio.NewReader(client), nil)
+			if err != nil {
+				t.Fatalf("read response: %v", err)
+			}
+			if resp.StatusCode != 408 {
+				t.Fatalf("status: got %d, want %d", resp.StatusCode, 408)
+			}
+			if !resp.Close {
+				t.Fatalf("connection should be closed after a timeout")
+			}
+		})
+	}
+}
+
+func TestUnreadBodyDiscardTimeout(t *testing.T) {
+	srv := New(8080, okHandler)
+	srv.IdleTimeout = 50 * time.Millisecond
+	client := serveConn(t, srv)
+
+	// the handler ignores the body, and the rest of it never arrives
+	io.WriteString(client, "POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 10\r\n\r\nabc")
+
+	br := bufio.NewReader(client)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("read response: %v", err)
+	}
+	readBody(t, resp)
+
+	if _, err := br.ReadByte(); err != io.EOF {
+		t.Fatalf("expected connection to be closed, got %v", err)
+	}
+}
+
+func TestReadTimeout(t *testing.T) {
+	bodyErr := make(chan error, 1)
+	srv := New(8080, func(w *response.Writer, r *request.Request) {
+		_, err := io.ReadAll(r.Body)
+		bodyErr <- err
+	})
+	srv.ReadTimeout = 50 * time.Millisecond
+	client := serveConn(t, srv)
+
+	// the body never arrives
+	io.WriteString(client, "POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 5\r\n\r\n")
+
+	select {
+	case err := <-bodyErr:
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Fatalf("expected deadline exceeded, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("body read did not time out")
+	}
+}
+
+func TestWriteTimeout(t *testing.T) {
+	writeErr := make(chan error, 1)
+	srv := New(8080, func(w *response.Writer, r *request.Request) {
+		writeErr <- w.WriteStatusLine(response.StatusOk)
+	})
+	srv.WriteTimeout = 50 * time.Millisecond
+	client := serveConn(t, srv)
+
+	// the response is never read
+	io.WriteString(client, "GET / HTTP/1.1\r\nHost: x\r\n\r\n")
+
+	select {
+	case err := <-writeErr:
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Fatalf("expected deadline exceeded, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("write did not time out")
+	}
+}
+
+func TestShutdownWaitsForActiveRequests(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	srv := New(8080, func(w *response.Writer, r *request.Request) {
+		close(started)
+		<-release
+		okHandler(w, r)
+	})
+	client := serveConn(t, srv)
+	go io.WriteString(client, "GET /slow HTTP/1.1\r\nHost: x\r\n\r\n")
+	<-started
+
+	shutdownErr := make(chan error, 1)
+	go func() {
+		shutdownErr <- srv.Shutdown(context.Background())
+	}()
+
+	select {
+	case err := <-shutdownErr:
+		t.Fatalf("shutdown returned before the handler finished: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+
+	br := bufio.NewReader(client)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("read response: %v", err)
+	}
+	if got := readBody(t, resp); got != "/slow" {
+		t.Fatalf("body: got %q, want %q", got, "/slow")
+	}
+
+	if _, err := br.ReadByte(); err != io.EOF {
+		t.Fatalf("expected connection to be closed after the response, got %v", err)
+	}
+
+	if err := <-shutdownErr; err != nil {
+		t.Fatalf("unexpected shutdown error: %v", err)
+	}
+}
+
+func TestShutdownClosesIdleConnections(t *testing.T) {
+	srv := New(8080, okHandler)
+	client := serveConn(t, srv)
+	br := bufio.NewReader(client)
+
+	io.WriteString(client, "GET / HTTP/1.1\r\nHost: x\r\n\r\n")
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("read response: %v", err)
+	}
+	readBody(t, resp)
+
+	if err := srv.Shutdown(context.Background()); err != nil {
+		t.Fatalf("unexpected shutdown error: %v", err)
+	}
+
+	if _, err := br.ReadByte(); err != io.EOF {
+		t.Fatalf("expected idle connection to be closed, got %v", err)
+	}
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	srv := New(8080, func(w *response.Writer, r *request.Request) {
+		close(started)
+		<-release
+	})
+	client := serveConn(t, srv)
+	go io.WriteString(client, "GET / HTTP/1.1\r\nHost: x\r\n\r\n")
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if err := srv.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected connection to be force-closed, got %v", err)
+	}
+}
+
+func TestShutdownSeesConnectionsNotYetServed(t *testing.T) {
+	srv := New(8080, okHandler)
+
+	// accepted, but its goroutine has not started
+	client, conn := net.Pipe()
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	if !srv.trackConn(conn) {
+		t.Fatalf("connection should be tracked before shutdown")
+	}
+
+	if err := srv.Shutdown(context.Background()); err != nil {
+		t.Fatalf("unexpected shutdown error: %v", err)
+	}
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected connection to be closed, got %v", err)
+	}
+
+	// one accepted after that is refused
+	_, late := net.Pipe()
+	if srv.trackConn(late) {
+		t.Fatalf("connection should not be tracked after shutdown")
+	}
+}
+
+func TestServeWaitsForShutdown(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	srv := New(0, func(w *response.Writer, r *request.Request) {
+		close(started)
+		<-release
+		w.Write([]byte("done"))
+	})
+	srv.Addr = "127.0.0.1:0"
+
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve() }()
+	addr := listenerAddr(t, srv)
+
+	client, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(client, "GET / HTTP/1.1\r\nHost: x\r\n\r\n")
+	<-started
+
+	shutdownErr := make(chan error, 1)
+	go func() { shutdownErr <- srv.Shutdown(context.Background()) }()
+
+	// the request is still being served, so Serve must not return yet
+	select {
+	case err := <-served:
+		t.Fatalf("Serve returned %v while a request was in flight", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(release)
+	resp, err := http.ReadResponse(bufio.NewReader(client), nil)
+	if err != nil {
+		t.Fatalf("read response: %v", err)
+	}
+	if got := readBody(t, resp); got != "done" {
+		t.Fatalf("body: got %q, want %q", got, "done")
+	}
+
+	if err := <-served; err != nil {
+		t.Fatalf("serve: %v", err)
+	}
+	if err := <-shutdownErr; err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+}
+
+func TestHandlerWritesNothing(t *testing.T) {
+	srv := New(8080, func(w *response.Writer, r *request.Request) {})
+	client := serveConn(t, srv)
+	br := bufio.NewReader(client)
+
+	for i := 0; i < 2; i++ {
+		go io.WriteString(client, "GET / HTTP/1.1\r\nHost: x\r\n\r\n")
+
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatalf("request %d: read response: %v", i, err)
+		}
+		if resp.StatusCode != 200 {
+			t.Fatalf("status: got %d, want %d", resp.StatusCode, 200)
+		}
+		if got := readBody(t, resp); got != "" {
+			t.Fatalf("body: got %q, want empty", got)
+		}
+	}
+}
+
+func TestStreamedNoContentKeepsConnectionInSync(t *testing.T) {
+	srv := New(8080, func(w *response.Writer, r *request.Request) {
+		if r.RequestLine.Path == "/ok" {
+			okHandler(w, r)
+			return
+		}
+		h := response.GetDefaultHeadersChunked()
+		w.EnableChunkedEncoding(h)
+		w.WriteStatusLine(response.StatusNoContent)
+		w.WriteHeaders(h)
+		w.FinalizeChunkedEncoding()
+	})
+	client := serveConn(t, srv)
+	br := bufio.NewReader(client)
+
+	go io.WriteString(client, "GET /empty HTTP/1.1\r\nHost: x\r\n\r\nGET /ok HTTP/1.1\r\nHost: x\r\n\r\n")
+
+	for _, want := range []int{204, 200} {
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatalf("read response: %v", err)
+		}
+		if resp.StatusCode != want {
+			t.Fatalf("status: got %d, want %d", resp.StatusCode, want)
+		}
+		readBody(t, resp)
+	}
+}
+
+func TestInvalidHeaderFieldAnswers500(t *testing.T) {
+	srv := New(8080, func(w *response.Writer, r *request.Request) {
+		// echoes the query, CRLF included, into a field
+		w.Header().Set("X-Echo", "a\r\nSet-Cookie: evil=1")
+		w.Write([]byte("Hello"))
+	})
+	client := serveConn(t, srv)
+
+	io.WriteString(client, "GET / HTTP/1.1\r\nHost: x\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(client), nil)
+	if err != nil {
+		t.Fatalf("read response: %v", err)
+	}
+	if resp.StatusCode != 500 {
+		t.Fatalf("status: got %d, want %d", resp.StatusCode, 500)
+	}
+	if _, ok := resp.Header["Set-Cookie"]; ok {
+		t.Fatalf("injected field was sent")
+	}
+	if got := readBody(t, resp); got != "" {
+		t.Fatalf("body: got %q, want empty", got)
+	}
+}
+
+func TestSmuggledRequestIsNotServed(t *testing.T) {
+	var paths []string
+	srv := New(8080, func(w *response.Writer, r *request.Request) {
+		paths = append(paths, r.RequestLine.Path)
+		okHandler(w, r)
+	})
+	client := serveConn(t, srv)
+	br := bufio.NewReader(client)
+
+	go io.WriteString(client, ""+
+		"POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 6\r\nTransfer-Encoding: chunked\r\n\r\n"+
+		"0\r\n\r\n"+
+		"GET /admin HTTP/1.1\r\nHost: x\r\n\r\n")
+
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("read response: %v", err)
+	}
+	if resp.StatusCode != 400 {
+		t.Fatalf("status: got %d, want %d", resp.StatusCode, 400)
+	}
+	if !resp.Close {
+		t.Fatalf("connection should be closed after a smuggling attempt")
+	}
+	readBody(t, resp)
+
+	if _, err := br.ReadByte(); err != io.EOF {
+		t.Fatalf("expected connection to be closed, got %v", err)
+	}
+	if len(paths) != 0 {
+		t.Fatalf("no request should reach the handler, got %q", paths)
+	}
+}
+
+func TestFragmentedRequest(t *testing.T) {
+	srv := New(8080, okHandler)
+	client := serveConn(t, srv)
+
+	go func() {
+		for _, segment := range []string{"GE", "T /frag", "mented HTTP/1", ".1\r\nHo", "st: x\r", "\n\r\n"} {
+			io.WriteString(client, segment)
+			time.Sleep(5 * time.Millisecond)
+		}
+	}()
+
+	resp, err := http.ReadResponse(bufio.NewReader(client), nil)
+	if err != nil {
+		t.Fatalf("read response: %v", err)
+	}
+	if got := readBody(t, resp); got != "/fragmented" {
+		t.Fatalf("body: got %q, want %q", got, "/fragmented")
+	}
+}
+
+func TestHTTP10(t *testing.T) {
+	srv := New(8080, okHandler)
+	client := serveConn(t, srv)
+	br := bufio.NewReader(client)
+
+	go io.WriteString(client, "GET /old HTTP/1.0\r\n\r\n")
+
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("read response: %v", err)
+	}
+	if resp.Proto != "HTTP/1.0" {
+		t.Fatalf("proto: got %q, want %q", resp.Proto, "HTTP/1.0")
+	}
+	if got := readBody(t, resp); got != "/old" {
+		t.Fatalf("body: got %q, want %q", got, "/old")
+	}
+
+	if _, err := br.ReadByte(); err != io.EOF {
+		t.Fatalf("HTTP/1.0 connection should be closed, got %v", err)
+	}
+}
+
+func TestHTTP10KeepAlive(t *testing.T) {
+	srv := New(8080, okHandler)
+	client := serveConn(t, srv)
+	br := bufio.NewReader(client)
+
+	for _, path := range []string{"/one", "/two"} {
+		go io.WriteString(client, "GET "+path+" HTTP/1.0\r\nConnection: keep-alive\r\n\r\n")
+
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatalf("read response: %v", err)
+		}
+		if resp.Close {
+			t.Fatalf("%s: connection should be kept alive", path)
+		}
+		if got := readBody(t, resp); got != path {
+			t.Fatalf("body: got %q, want %q", got, path)
+		}
+	}
+}
+
+func TestUnsupportedVersion(t *testing.T) {
+	srv := New(8080, okHandler)
+	client := serveConn(t, srv)
+
+	go io.WriteString(client, "GET / HTTP/2.0\r\n\r\n")
+
+	resp, err := http.ReadResponse(bufio.NewReader(client), nil)
+	if err != nil {
+		t.Fatalf("read response: %v", err)
+	}
+	if resp.StatusCode != 505 {
+		t.Fatalf("status: got %d, want %d", resp.StatusCode, 505)
+	}
+}
+
+func TestPathPolicy(t *testing.T) {
+	tests := []struct {
+		name string
+		policy request.PathPolicy
+		req string
+		status int
+		location string
+		body string
+	}{
+		{"clean path", request.PathRedirect, "GET /a/b HTTP/1.1\r\n\r\n", 200, "", "/a/b"},
+		{"redirect", request.PathRedirect, "GET /a/../b?x=1 HTTP/1.1\r\n\r\n", 301, "/b?x=1", ""},
+		{"redirect keeps method", request.PathRedirect, "POST //a/./b HTTP/1.1\r\n\r\n", 308, "/a/b", ""},
+		{"redirect encoded", request.PathRedirect, "GET /%2e%2e/a%20b HTTP/1.1\r\n\r\n", 301, "/a%20b", ""},
+		{"reject", request.PathReject, "GET /a/../b HTTP/1.1\r\n\r\n", 400, "", ""},
+		{"pass through", request.PathPassThrough, "GET /a/../b HTTP/1.1\r\n\r\n", 200, "", "/a/../b"},
+		{"encoded slash", request.PathPassThrough, "GET /a%2fb HTTP/1.1\r\n\r\n", 400, "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := New(8080, okHandler)
+			srv.PathPolicy = tt.policy
+			client := serveConn(t, srv)
+
+			go io.WriteString(client, tt.req)
+
+			resp, err := http.ReadResponse(bufio.NewReader(client), nil)
+			if err != nil {
+				t.Fatalf("read response: %v", err)
+			}
+			if resp.StatusCode != tt.status {
+				t.Fatalf("status: got %d, want %d", resp.StatusCode, tt.status)
+			}
+			if got := resp.Header.Get("Location"); got != tt.location {
+				t.Fatalf("location: got %q, want %q", got, tt.location)
+			}
+			if got := readBody(t, resp); got != tt.body {
+				t.Fatalf("body: got %q, want %q", got, tt.body)
+			}
+		})
+	}
+}
+
+func TestPanicBeforeResponse(t *testing.T) {
+	var recovered any
+	var stack []byte
+	srv := New(8080, func(w *response.Writer, r *request.Request) {
+		w.Header().Replace("X-Partial", "yes")
+		w.Write([]byte("never sent"))
+		panic("boom")
+	})
+	srv.PanicHandler = func(r *request.Request, p any, s []byte) {
+		recovered, stack = p, s
+	}
+	client := serveConn(t, srv)
+	br := bufio.NewReader(client)
+
+	go io.WriteString(client, "GET / HTTP/1.1\r\n\r\n")
+
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("read response: %v", err)
+	}
+	if resp.StatusCode != 500 {
+		t.Fatalf("status: got %d, want %d", resp.StatusCode, 500)
+	}
+	if resp.Header.Get("X-Partial") != "" {
+		t.Fatalf("headers set before the panic were sent")
+	}
+	if body := readBody(t, resp); body != "" {
+		t.Fatalf("body: got %q, want empty", body)
+	}
+	if !resp.Close {
+		t.Fatalf("connection should be closed after a panic")
+	}
+
+	if recovered != "boom" {
+		t.Fatalf("panic handler: got %v, want %q", recovered, "boom")
+	}
+	if !strings.Contains(string(stack), "TestPanicBeforeResponse") {
+		t.Fatalf("stack does not name the panicking handler:\n%s", stack)
+	}
+}
+
+func TestPanickingPanicHandler(t *testing.T) {
+	srv := New(8080, func(w *response.Writer, r *request.Request) {
+		panic("boom")
+	})
+	srv.PanicHandler = func(r *request.Request, p any, s []byte) {
+		panic("reporter down")
+	}
+	client := serveConn(t, srv)
+
+	go io.WriteString(client, "GET / HTTP/1.1\r\n\r\n")
+
+	resp, err := http.ReadResponse(bufio.NewReader(client), nil)
+	if err != nil {
+		t.Fatalf("read response: %v", err)
+	}
+	if resp.StatusCode != 500 {
+		t.Fatalf("status: got %d, want %d", resp.StatusCode, 500)
+	}
+}
+
+func TestPanicAfterHeaders(t *testing.T) {
+	srv := New(8080, func(w *response.Writer, r *request.Request) {
+		w.Write([]byte("partial"))
+		w.Flush()
+		panic("boom")
+	})
+	client := serveConn(t, srv)
+
+	go io.WriteString(client, "GET / HTTP/1.1\r\n\r\n")
+
+	resp, err := http.ReadResponse(bufio.NewReader(client), nil)
+	if err != nil {
+		t.Fatalf("read response: %v", err)
+	}
+	if resp.StatusCode != 200 {
+		t.Fatalf("status: got %d, want %d", resp.StatusCode, 200)
+	}
+
+	// the chunked body is never terminated, so it cannot pass as complete
+	body, err := io.ReadAll(resp.Body)
+	if err == nil {
+		t.Fatalf("partial body %q read without error", body)
+	}
+	if string(body) != "partial" {
+		t.Fatalf("body: got %q, want %q", body, "partial")
+	}
+}
+
+func TestPanicDoesNotAffectOtherConnections(t *testing.T) {
+	srv := New(8080, func(w *response.Writer, r *request.Request) {
+		if r.Target.Path == "/panic" {
+			panic("boom")
+		}
+		okHandler(w, r)
+	})
+
+	bad := serveConn(t, srv)
+	go io.WriteString(bad, "GET /panic HTTP/1.1\r\n\r\n")
+	if _, err := http.ReadResponse(bufio.NewReader(bad), nil); err != nil {
+		t.Fatalf("read response: %v", err)
+	}
+
+	good := serveConn(t, srv)
+	go io.WriteString(good, "GET /fine HTTP/1.1\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(good), nil)
+	if err != nil {
+		t.Fatalf("read response: %v", err)
+	}
+	if body := readBody(t, resp); body != "/fine" {
+		t.Fatalf("body: got %q, want %q", body, "/fine")
+	}
+}
+
+// waitForCancel is a handler that blocks until its request's context ends
+// and reports the context's error on errs.
+func waitForCancel(errs chan<- error) Handler {
+	return func(w *response.Writer, r *request.Request) {
+		select {
+		case <-r.Context().Done():
+			errs <- r.Context().Err()
+		case <-time.After(2 * time.Second):
+			errs <- nil
+		}
+	}
+}
+
+func TestContextCanceledOnClientClose(t *testing.T) {
+	tests := []struct {
+		name string
+		request string
+	}{
+		{"no body", "GET / HTTP/1.1\r\n\r\n"},
+		{"body read", "POST / HTTP/1.1\r\nContent-Length: 5\r\n\r\nHello"},
+		{"chunked body read", "POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nHello\r\n0\r\n\r\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			errs := make(chan error, 1)
+			wait := waitForCancel(errs)
+			srv := New(8080, func(w *response.Writer, r *request.Request) {
+				io.ReadAll(r.Body)
+				wait(w, r)
+			})
+			client := serveConn(t, srv)
+
+			io.WriteString(client, tt.request)
+			client.Close()
+
+			if err := <-errs; err != context.Canceled {
+				t.Fatalf("context error: got %v, want %v", err, context.Canceled)
+			}
+		})
+	}
+}
+
+func TestContextCanceledOnClose(t *testing.T) {
+	errs := make(chan error, 1)
+	srv := New(8080, waitForCancel(errs))
+	client := serveConn(t, srv)
+
+	io.WriteString(client, "GET / HTTP/1.1\r\n\r\n")
+	srv.Close()
+
+	if err := <-errs; err != context.Canceled {
+		t.Fatalf("context error: got %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestContextCanceledWhenShutdownExpires(t *testing.T) {
+	errs := make(chan error, 1)
+	started := make(chan struct{})
+	srv := New(8080, func(w *response.Writer, r *request.Request) {
+		close(started)
+		waitForCancel(errs)(w, r)
+	})
+	client := serveConn(t, srv)
+
+	go io.WriteString(client, "GET / HTTP/1.1\r\n\r\n")
+	<-started
+
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	shutdownErr := make(chan error, 1)
+	go func() { shutdownErr <- srv.Shutdown(ctx) }()
+
+	if err := <-errs; err != context.Canceled {
+		t.Fatalf("context error: got %v, want %v", err, context.Canceled)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Fatalf("context canceled after %v, before the shutdown deadline", elapsed)
+	}
+	if err := <-shutdownErr; err != context.DeadlineExceeded {
+		t.Fatalf("shutdown: got %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestShutdownLetsContextAwareHandlersFinish(t *testing.T) {
+	started := make(chan struct{})
+	srv := New(8080, func(w *response.Writer, r *request.Request) {
+		close(started)
+		select {
+		case <-r.Context().Done():
+			w.Write([]byte("canceled"))
+		case <-time.After(100 * time.Millisecond):
+			w.Write([]byte("finished"))
+		}
+	})
+	client := serveConn(t, srv)
+
+	go io.WriteString(client, "GET / HTTP/1.1\r\n\r\n")
+	<-started
+	go srv.Shutdown(context.Background())
+
+	resp, err := http.ReadResponse(bufio.NewReader(client), nil)
+	if err != nil {
+		t.Fatalf("read response: %v", err)
+	}
+	if body := readBody(t, resp); body != "finished" {
+		t.Fatalf("body: got %q, want %q", body, "finished")
+	}
+}
+
+func TestHandlerTimeout(t *testing.T) {
+	errs := make(chan error, 1)
+	srv := New(8080, waitForCancel(errs))
+	srv.HandlerTimeout = 50 * time.Millisecond
+	client := serveConn(t, srv)
+
+	go io.WriteString(client, "GET / HTTP/1.1\r\n\r\n")
+
+	if err := <-errs; err != context.DeadlineExceeded {
+		t.Fatalf("context error: got %v, want %v", err, context.DeadlineExceeded)
+	}
+	// the connection is still usable once the handler returns
+	resp, err := http.ReadResponse(bufio.NewReader(client), nil)
+	if err != nil {
+		t.Fatalf("read response: %v", err)
+	}
+	if resp.StatusCode != 200 {
+		t.Fatalf("status: got %d, want %d", resp.StatusCode, 200)
+	}
+}
+
+func TestContextOutlivesPipelinedRequest(t *testing.T) {
+	srv := New(8080, func(w *response.Writer, r *request.Request) {
+		// give the server time to read the next request ahead
+		time.Sleep(20 * time.Millisecond)
+		if err := r.Context().Err(); err != nil {
+			t.Errorf("context ended while the client was connected: %v", err)
+		}
+		okHandler(w, r)
+	})
+	client := serveConn(t, srv)
+	br := bufio.NewReader(client)
+
+	go io.WriteString(client, "GET /a HTTP/1.1\r\n\r\nGET /b HTTP/1.1\r\n\r\n")
+
+	for _, want := range []string{"/a", "/b"} {
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatalf("read response: %v", err)
+		}
+		if body := readBody(t, resp); body != want {
+			t.Fatalf("body: got %q, want %q", body, want)
+		}
+	}
+}
+
+func TestWriteErrorStopsHandler(t *testing.T) {
+	errs := make(chan error, 1)
+	srv := New(8080, func(w *response.Writer, r *request.Request) {
+		w.Write([]byte("first"))
+		w.Flush()
+		<-r.Context().Done()
+		for i := 0; i < 100; i++ {
+			if _, err := w.Write([]byte("more")); err != nil {
+				errs <- err
+				return
+			}
+		}
+		errs <- nil
+	})
+	client := serveConn(t, srv)
+	br := bufio.NewReader(client)
+
+	go io.WriteString(client, "GET / HTTP/1.1\r\n\r\n")
+	if _, err := http.ReadResponse(br, nil); err != nil {
+		t.Fatalf("read response: %v", err)
+	}
+	client.Close()
+
+	if err := <-errs; err == nil {
+		t.Fatalf("writes to a closed connection succeeded")
+	}
+}
+
+func TestConnectionMetadata(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+
+	reqs := make(chan *request.Request, 3)
+	srv := New(8080, func(w *response.Writer, r *request.Request) {
+		reqs <- r
+		okHandler(w, r)
+	})
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			srv.trackConn(conn)
+			go srv.handleConn(conn)
+		}
+	}()
+
+	before := time.Now()
+	first, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer first.Close()
+	second, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer second.Close()
+
+	send := func(conn net.Conn, br *bufio.Reader) *request.Request {
+		t.Helper()
+		io.WriteString(conn, "GET / HTTP/1.1\r\n\r\n")
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatalf("read response: %v", err)
+		}
+		readBody(t, resp)
+		return <-reqs
+	}
+
+	br := bufio.NewReader(first)
+	a1 := send(first, br)
+	a2 := send(first, br)
+	b1 := send(second, bufio.NewReader(second))
+
+	if a1.RemoteAddr != first.LocalAddr().String() || a1.LocalAddr != first.RemoteAddr().String() {
+		t.Fatalf("addresses: got %s -> %s, want %s -> %s", a1.RemoteAddr, a1.LocalAddr, first.LocalAddr(), first.RemoteAddr())
+	}
+	if a1.ConnID != a2.ConnID || a1.ConnID == b1.ConnID {
+		t.Fatalf("conn IDs: got %d, %d and %d", a1.ConnID, a2.ConnID, b1.ConnID)
+	}
+	if a1.Seq != 1 || a2.Seq != 2 || b1.Seq != 1 {
+		t.Fatalf("sequence numbers: got %d, %d and %d", a1.Seq, a2.Seq, b1.Seq)
+	}
+	if a1.Received.Before(before) || a2.Received.Before(a1.Received) {
+		t.Fatalf("received times out of order: %v, %v", a1.Received, a2.Received)
+	}
+}
+
+func TestLargeUnreadBodyClosesConnection(t *testing.T) {
+	tests := []struct {
+		name string
+		head string
+		body io.Reader
+	}{
+		{
+			name: "content-length",
+			head: "POST /upload HTTP/1.1\r\nContent-Length: 10000000000\r\n\r\n",
+			body: strings.NewReader("only the start"),
+		},
+		{
+			name: "chunked",
+			head: "POST /upload HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n",
+			body: endlessChunks{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := New(8080, func(w *response.Writer, r *request.Request) {
+				w.SetStatus(response.StatusContentTooLarge)
+			})
+			client := serveConn(t, srv)
+			br := bufio.NewReader(client)
+
+			go func() {
+				io.WriteString(client, tt.head)
+				io.Copy(client, tt.body)
+			}()
+
+			resp, err := http.ReadResponse(br, nil)
+			if err != nil {
+				t.Fatalf("read response: %v", err)
+			}
+			if resp.StatusCode != 413 {
+				t.Fatalf("status: got %d, want %d", resp.StatusCode, 413)
+			}
+			if !resp.Close {
+				t.Fatalf("response should announce Connection: close")
+			}
+			readBody(t, resp)
+			if _, err := br.ReadByte(); err != io.EOF {
+				t.Fatalf("connection should be closed, got %v", err)
+			}
+		})
+	}
+}
+
+// endlessChunks is a chunked body that never ends.
+type endlessChunks struct{}
+
+func (endlessChunks) Read(p []byte) (int, error) {
+	chunk := "400\r\n" + strings.Repeat("x", 0x400) + "\r\n"
+	if len(p) < len(chunk) {
+		return 0, io.ErrShortBuffer
+	}
+	return copy(p, chunk), nil
+}
+
+func TestSmallUnreadBodyKeepsConnection(t *testing.T) {
+	srv := New(8080, func(w *response.Writer, r *request.Request) {
+		w.Write([]byte(r.Target.Path))
+	})
+	client := serveConn(t, srv)
+	br := bufio.NewReader(client)
+
+	body := strings.Repeat("x", 100*1024)
+	go io.WriteString(client, fmt.Sprintf("POST /upload HTTP/1.1\r\nContent-Length: %d\r\n\r\n%sGET /next HTTP/1.1\r\n\r\n", len(body), body))
+
+	for _, path := range []string{"/upload", "/next"} {
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatalf("%s: read response: %v", path, err)
+		}
+		if resp.Close {
+			t.Fatalf("%s: connection should be kept open", path)
+		}
+		if got := readBody(t, resp); got != path {
+			t.Fatalf("body: got %q, want %q", got, path)
+		}
+	}
+}
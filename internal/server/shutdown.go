@@ -0,0 +1,146 @@
+package server
+
+import (
+	"context"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+const DefaultShutdownTimeout = 30 * time.Second
+
+type connState int
+
+const (
+	// waiting for the next request to start arriving
+	stateIdle connState = iota
+	// reading a request or writing its response
+	stateActive
+)
+
+func (s *Server) setConnState(conn net.Conn, state connState) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.conns[conn] = state
+}
+
+// trackConn registers a newly accepted conn as idle, so that Shutdown
+// waits for or closes it even before its goroutine starts. It reports
+// false, leaving conn untracked, once the server is shutting down.
+func (s *Server) trackConn(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// checked under mu: closeConns, which runs after done is closed, sees
+	// every connection tracked before then
+	if s.shuttingDown() {
+		return false
+	}
+	s.conns[conn] = stateIdle
+	return true
+}
+
+func (s *Server) forgetConn(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, conn)
+}
+
+func (s *Server) shuttingDown() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// stopAccepting marks the server as shutting down and closes the listener
+// so that Serve returns.
+func (s *Server) stopAccepting() {
+	s.closeOnce.Do(func() {
+		close(s.done)
+	})
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ln != nil {
+		s.ln.Close()
+	}
+}
+
+// closeConns closes the tracked connections, or only the idle ones, and
+// reports how many connections are still open afterwards.
+func (s *Server) closeConns(idleOnly bool) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	open := 0
+	for conn, state := range s.conns {
+		if idleOnly && state != stateIdle {
+			open++
+			continue
+		}
+		conn.Close()
+		delete(s.conns, conn)
+	}
+	return open
+}
+
+// Close stops the server immediately, closing the listener and every open
+// connection without waiting for in-flight requests, whose contexts are
+// canceled.
+func (s *Server) Close() {
+	s.stopAccepting()
+	s.cancel()
+	s.closeConns(false)
+}
+
+// Shutdown stops accepting connections, closes idle keep-alive connections
+// and waits for active ones to finish their current request. If ctx ends
+// first, the contexts of the requests still in flight are canceled, the
+// remaining connections are closed and ctx's error is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	// counted before stopAccepting lets Serve return
+	s.shutdowns.Add(1)
+	defer s.shutdowns.Done()
+	s.stopAccepting()
+
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		// connections go idle as their handlers finish, so keep sweeping
+		if s.closeConns(true) == 0 {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			s.cancel()
+			s.closeConns(false)
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Server) handleShutdownSignals() {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	<-sigCh
+
+	// keep Serve from returning until the outcome is logged
+	s.shutdowns.Add(1)
+	defer s.shutdowns.Done()
+	log.Printf("shutting down...")
+
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultShutdownTimeout)
+	defer cancel()
+
+	if err := s.Shutdown(ctx); err != nil {
+		log.Printf("shutdown: %v, closed remaining connections", err)
+	}
+}
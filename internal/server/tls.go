@@ -0,0 +1,227 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// DefaultCertCheckInterval is how often ServeTLS checks certificate files
+// for changes unless Server.CertCheckInterval says otherwise.
+const DefaultCertCheckInterval = 30 * time.Second
+
+var ERROR_NO_CERTIFICATE = fmt.Errorf("no TLS certificate configured")
+
+// certFiles is a certificate and key loaded from disk, with the
+// modification times they had when they were loaded.
+type certFiles struct {
+	certFile string
+	keyFile string
+	certMod time.Time
+	keyMod time.Time
+}
+
+// CertLoader holds certificates loaded from disk and picks one for each TLS
+// handshake by the server name the client asks for (SNI). Certificates can
+// be reloaded while the server runs: connections already established keep
+// the certificate they started with, new ones get the reloaded one.
+type CertLoader struct {
+	mu sync.RWMutex
+	files []certFiles
+	certs []*tls.Certificate
+}
+
+func NewCertLoader() *CertLoader {
+	return &CertLoader{}
+}
+
+// Add loads a certificate and its key. The first certificate added is the
+// default, used when no other one matches the requested server name.
+func (l *CertLoader) Add(certFile, keyFile string) error {
+	f := certFiles{certFile: certFile, keyFile: keyFile}
+	cert, err := f.load()
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.files = append(l.files, f)
+	l.certs = append(l.certs, cert)
+	return nil
+}
+
+// Reload loads every certificate again. If any of them fails to load, all
+// of them are kept as they were.
+func (l *CertLoader) Reload() error {
+	l.mu.RLock()
+	files := append([]certFiles(nil), l.files...)
+	l.mu.RUnlock()
+
+	certs := make([]*tls.Certificate, len(files))
+	for i := range files {
+		cert, err := files[i].load()
+		if err != nil {
+			return err
+		}
+		certs[i] = cert
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	// certificates added meanwhile are kept as they are
+	copy(l.files, files)
+	copy(l.certs, certs)
+	return nil
+}
+
+func (l *CertLoader) empty() bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return len(l.certs) == 0
+}
+
+// changed reports whether any certificate or key file was modified since it
+// was last loaded.
+func (l *CertLoader) changed() bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	for _, f := range l.files {
+		certMod, keyMod := f.modTimes()
+		if !certMod.Equal(f.certMod) || !keyMod.Equal(f.keyMod) {
+			return true
+		}
+	}
+	return false
+}
+
+// Watch reloads the certificates when their files change, checking every
+// interval, and when the process receives SIGHUP. It returns once done is
+// closed. Failed reloads are logged and the old certificates kept.
+func (l *CertLoader) Watch(interval time.Duration, done <-chan struct{}) {
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	defer signal.Stop(sighup)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-sighup:
+		case <-ticker.C:
+			if !l.changed() {
+				continue
+			}
+		}
+
+		if err := l.Reload(); err != nil {
+			log.Printf("reloading certificates: %v", err)
+			continue
+		}
+		log.Printf("reloaded certificates")
+	}
+}
+
+// GetCertificate picks the certificate for a handshake: the first whose
+// names match the server name sent by the client, or else the default.
+// It is meant for tls.Config.GetCertificate.
+func (l *CertLoader) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if len(l.certs) == 0 {
+		return nil, ERROR_NO_CERTIFICATE
+	}
+
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if name != "" {
+		for _, cert := range l.certs {
+			if cert.Leaf == nil {
+				continue
+			}
+			for _, n := range cert.Leaf.DNSNames {
+				if matchHostname(strings.ToLower(n), name) {
+					return cert, nil
+				}
+			}
+		}
+	}
+	return l.certs[0], nil
+}
+
+// matchHostname reports whether name is covered by pattern, which may be a
+// wildcard such as *.example.com covering a single label.
+func matchHostname(pattern, name string) bool {
+	if pattern == name {
+		return true
+	}
+	suffix, ok := strings.CutPrefix(pattern, "*.")
+	if !ok {
+		return false
+	}
+	label, rest, ok := strings.Cut(name, ".")
+	return ok && label != "" && rest == suffix
+}
+
+func (f *certFiles) load() (*tls.Certificate, error) {
+	// read the times first, so that a change made while loading is picked
+	// up by the next check
+	f.certMod, f.keyMod = f.modTimes()
+
+	cert, err := tls.LoadX509KeyPair(f.certFile, f.keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
+
+func (f *certFiles) modTimes() (time.Time, time.Time) {
+	var certMod, keyMod time.Time
+	if fi, err := os.Stat(f.certFile); err == nil {
+		certMod = fi.ModTime()
+	}
+	if fi, err := os.Stat(f.keyFile); err == nil {
+		keyMod = fi.ModTime()
+	}
+	return certMod, keyMod
+}
+
+// tlsConfig builds the configuration ServeTLS listens with: TLSConfig, if
+// set, with certificates served from Certs, to which certFile and keyFile
+// are added if given, and client certificates handled as ClientAuth says.
+func (s *Server) tlsConfig(certFile, keyFile string) (*tls.Config, error) {
+	config := &tls.Config{}
+	if s.TLSConfig != nil {
+		config = s.TLSConfig.Clone()
+	}
+
+	if s.Certs == nil {
+		s.Certs = NewCertLoader()
+	}
+	if certFile != "" || keyFile != "" {
+		if err := s.Certs.Add(certFile, keyFile); err != nil {
+			return nil, err
+		}
+	}
+
+	if !s.Certs.empty() {
+		config.GetCertificate = s.Certs.GetCertificate
+	} else if len(config.Certificates) == 0 && config.GetCertificate == nil {
+		return nil, ERROR_NO_CERTIFICATE
+	}
+
+	if err := applyClientAuth(config, s.ClientAuth, s.ClientCAs); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
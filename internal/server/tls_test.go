@@ -0,0 +1,361 @@
+package server
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/reche13/http-from-scratch/internal/request"
+	"github.com/reche13/http-from-scratch/internal/response"
+)
+
+// testCert is a certificate generated for a test, with its key.
+type testCert struct {
+	cert *x509.Certificate
+	key *ecdsa.PrivateKey
+}
+
+// newCert creates a certificate from tmpl with a fresh key, valid for an
+// hour either side of now. It is signed by parent, or self-signed if parent
+// is nil.
+func newCert(t *testing.T, tmpl *x509.Certificate, parent *testCert) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+
+	tmpl.NotBefore = time.Now().Add(-time.Hour)
+	tmpl.NotAfter = time.Now().Add(time.Hour)
+	issuer, signer := tmpl, key
+	if parent != nil {
+		issuer, signer = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, issuer, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatalf("creating certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("parsing certificate: %v", err)
+	}
+	return &testCert{cert: cert, key: key}
+}
+
+func (c *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.cert.Raw}, PrivateKey: c.key}
+}
+
+// writeCert generates a self-signed server certificate for names with the
+// given serial number and writes it and its key as PEM files in dir.
+func writeCert(t *testing.T, dir, prefix string, serial int64, names ...string) (string, string) {
+	t.Helper()
+	c := newCert(t, &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject: pkix.Name{CommonName: names[0]},
+		DNSNames: names,
+		KeyUsage: x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, nil)
+
+	keyDER, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatalf("marshaling key: %v", err)
+	}
+
+	certFile := filepath.Join(dir, prefix+".crt")
+	keyFile := filepath.Join(dir, prefix+".key")
+	writePEM(t, certFile, "CERTIFICATE", c.cert.Raw)
+	writePEM(t, keyFile, "EC PRIVATE KEY", keyDER)
+	return certFile, keyFile
+}
+
+func writePEM(t *testing.T, file, typ string, der []byte) {
+	t.Helper()
+	data := pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der})
+	if err := os.WriteFile(file, data, 0o600); err != nil {
+		t.Fatalf("writing %s: %v", file, err)
+	}
+}
+
+// serveTLS serves srv with TLS on a local port and returns its address.
+func serveTLS(t *testing.T, srv *Server, certFile, keyFile string) string {
+	t.Helper()
+	config, err := srv.tlsConfig(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("tls config: %v", err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	go srv.serveListener(tls.NewListener(ln, config))
+	t.Cleanup(srv.Close)
+	return ln.Addr().String()
+}
+
+// dialTLS connects to addr asking for serverName, without verifying the
+// self-signed certificate, and returns the serial number the server sent.
+func dialTLS(t *testing.T, addr, serverName string) (*tls.Conn, int64) {
+	t.Helper()
+	conn, err := tls.Dial("tcp", addr, &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return conn, conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64()
+}
+
+func get(t *testing.T, conn net.Conn, br *bufio.Reader) string {
+	t.Helper()
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: x\r\n\r\n")
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("read response: %v", err)
+	}
+	return readBody(t, resp)
+}
+
+func TestServeTLS(t *testing.T) {
+	certFile, keyFile := writeCert(t, t.TempDir(), "site", 1, "example.test")
+	srv := New(0, func(w *response.Writer, r *request.Request) {
+		if r.TLS == nil {
+			w.Write([]byte("plain"))
+			return
+		}
+		w.Write([]byte(r.TLS.ServerName))
+	})
+	addr := serveTLS(t, srv, certFile, keyFile)
+
+	conn, _ := dialTLS(t, addr, "example.test")
+	if got := get(t, conn, bufio.NewReader(conn)); got != "example.test" {
+		t.Fatalf("body: got %q, want %q", got, "example.test")
+	}
+}
+
+func TestServeTLSWithoutCertificate(t *testing.T) {
+	srv := New(0, okHandler)
+	if err := srv.ServeTLS("", ""); err != ERROR_NO_CERTIFICATE {
+		t.Fatalf("error: got %v, want %v", err, ERROR_NO_CERTIFICATE)
+	}
+}
+
+func TestSNI(t *testing.T) {
+	dir := t.TempDir()
+	srv := New(0, okHandler)
+	srv.Certs = NewCertLoader()
+	for i, names := range [][]string{{"default.test"}, {"a.test"}, {"*.b.test"}} {
+		certFile, keyFile := writeCert(t, dir, fmt.Sprint("cert", i), int64(i+1), names...)
+		if err := srv.Certs.Add(certFile, keyFile); err != nil {
+			t.Fatalf("add: %v", err)
+		}
+	}
+	addr := serveTLS(t, srv, "", "")
+
+	tests := []struct {
+		serverName string
+		serial int64
+	}{
+		{"a.test", 2},
+		{"A.TEST", 2},
+		{"x.b.test", 3},
+		{"b.test", 1},
+		{"x.y.b.test", 1},
+		{"unknown.test", 1},
+		{"", 1},
+	}
+
+	for _, tt := range tests {
+		if _, serial := dialTLS(t, addr, tt.serverName); serial != tt.serial {
+			t.Errorf("%q: got certificate %d, want %d", tt.serverName, serial, tt.serial)
+		}
+	}
+}
+
+func TestCertReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeCert(t, dir, "site", 1, "example.test")
+	srv := New(0, okHandler)
+	addr := serveTLS(t, srv, certFile, keyFile)
+
+	old, serial := dialTLS(t, addr, "example.test")
+	if serial != 1 {
+		t.Fatalf("serial: got %d, want 1", serial)
+	}
+	oldReader := bufio.NewReader(old)
+	get(t, old, oldReader)
+
+	writeCert(t, dir, "site", 2, "example.test")
+	if err := srv.Certs.Reload(); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+
+	if _, serial := dialTLS(t, addr, "example.test"); serial != 2 {
+		t.Fatalf("serial after reload: got %d, want 2", serial)
+	}
+	// the connection made before the reload is still served
+	if got := get(t, old, oldReader); got != "/" {
+		t.Fatalf("old connection: got %q", got)
+	}
+}
+
+func TestCertReloadKeepsOldOnError(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeCert(t, dir, "site", 1, "example.test")
+	l := NewCertLoader()
+	if err := l.Add(certFile, keyFile); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+
+	os.WriteFile(keyFile, []byte("garbage"), 0o600)
+	if err := l.Reload(); err == nil {
+		t.Fatalf("reload of a broken key succeeded")
+	}
+
+	cert, err := l.GetCertificate(&tls.ClientHelloInfo{ServerName: "example.test"})
+	if err != nil || cert.Leaf.SerialNumber.Int64() != 1 {
+		t.Fatalf("certificate after failed reload: %v, %v", cert, err)
+	}
+}
+
+func TestCertWatch(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeCert(t, dir, "site", 1, "example.test")
+	l := NewCertLoader()
+	if err := l.Add(certFile, keyFile); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go l.Watch(10*time.Millisecond, done)
+
+	writeCert(t, dir, "site", 2, "example.test")
+	// make sure the change is visible even on filesystems with coarse
+	// modification times
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+	os.Chtimes(keyFile, later, later)
+
+	for start := time.Now(); time.Since(start) < 2*time.Second; time.Sleep(10 * time.Millisecond) {
+		cert, _ := l.GetCertificate(&tls.ClientHelloInfo{})
+		if cert.Leaf.SerialNumber.Int64() == 2 {
+			return
+		}
+	}
+	t.Fatalf("certificate was not reloaded after its files changed")
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	certFile, keyFile := writeCert(t, t.TempDir(), "site", 1, "example.test")
+	srv := New(0, okHandler)
+	// no header timeout: the idle timeout bounds the handshake
+	srv.IdleTimeout = 50 * time.Millisecond
+	addr := serveTLS(t, srv, certFile, keyFile)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// never start the handshake; the server must give up and close
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("read: got %v, want %v", err, io.EOF)
+	}
+}
+
+func TestPanicAbortsTLSConnection(t *testing.T) {
+	certFile, keyFile := writeCert(t, t.TempDir(), "site", 1, "example.test")
+	srv := New(0, func(w *response.Writer, r *request.Request) {
+		w.Write([]byte("partial"))
+		w.Flush()
+		panic("boom")
+	})
+	addr := serveTLS(t, srv, certFile, keyFile)
+
+	conn, _ := dialTLS(t, addr, "example.test")
+	// HTTP/1.0 gets a close-delimited body, which only a clean close ends
+	io.WriteString(conn, "GET / HTTP/1.0\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("read response: %v", err)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err == nil {
+		t.Fatalf("partial body %q read as complete", body)
+	}
+}
+
+// listenerAddr waits for srv to start listening and returns its address.
+func listenerAddr(t *testing.T, srv *Server) string {
+	t.Helper()
+	for start := time.Now(); time.Since(start) < 2*time.Second; time.Sleep(5 * time.Millisecond) {
+		srv.mu.Lock()
+		ln := srv.ln
+		srv.mu.Unlock()
+		if ln != nil {
+			return ln.Addr().String()
+		}
+	}
+	t.Fatalf("server did not start listening")
+	return ""
+}
+
+func TestServeTLSEndToEnd(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeCert(t, dir, "site", 1, "example.test")
+	srv := New(0, okHandler)
+	srv.Addr = "127.0.0.1:0"
+	srv.CertCheckInterval = 10 * time.Millisecond
+
+	served := make(chan error, 1)
+	go func() { served <- srv.ServeTLS(certFile, keyFile) }()
+	addr := listenerAddr(t, srv)
+
+	conn, serial := dialTLS(t, addr, "example.test")
+	if serial != 1 {
+		t.Fatalf("serial: got %d, want 1", serial)
+	}
+	if got := get(t, conn, bufio.NewReader(conn)); got != "/" {
+		t.Fatalf("body: got %q, want %q", got, "/")
+	}
+
+	// the files changing on disk is picked up by the watcher ServeTLS runs
+	writeCert(t, dir, "site", 2, "example.test")
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+	os.Chtimes(keyFile, later, later)
+
+	reloaded := false
+	for start := time.Now(); time.Since(start) < 2*time.Second && !reloaded; time.Sleep(10 * time.Millisecond) {
+		_, serial := dialTLS(t, addr, "example.test")
+		reloaded = serial == 2
+	}
+	if !reloaded {
+		t.Fatalf("certificate was not reloaded after its files changed")
+	}
+
+	srv.Close()
+	if err := <-served; err != nil {
+		t.Fatalf("ServeTLS: %v", err)
+	}
+}
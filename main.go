@@ -2,13 +2,15 @@ package main
 
 import (
 	"log"
+	"os"
 
 	"github.com/reche13/http-from-scratch/examples"
 	"github.com/reche13/http-from-scratch/internal/server"
 )
 
 func main() {
-	srv := server.New(8080, examples.Handler)
+	srv := server.New(8080, examples.NewRouter().Serve)
+	srv.AccessLog = server.NewAccessLog(os.Stdout, server.LogCombined)
 
 	if err := srv.Serve(); err != nil {
 		log.Fatalf("server error: %v", err)